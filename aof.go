@@ -0,0 +1,599 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+/************************ AOF ARCHIVE ************************/
+// Point-in-time recovery. Redis 7 keeps its append-only file as a base
+// snapshot plus incremental files listed in a manifest, and with
+// aof-timestamp-enabled it writes "#TS:<unix>" before the commands of every
+// second. archive-aof (run from cron, e.g. every minute) copies these files
+// to redis_<port>/aof; pitr rebuilds the dataset as it was at a given time.
+
+const aofDirName = "aof"
+
+// aofFile is one "file <name> seq <n> type <b|h|i>" line of a manifest.
+type aofFile struct {
+	Name string
+	Seq  int
+	Type string
+}
+
+// aofGeneration is a base file with the increments written on top of it.
+type aofGeneration struct {
+	Base     aofFile
+	Incrs    []aofFile
+	BaseTime time.Time
+}
+
+func parseAOFManifest(path string) ([]aofFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var out []aofFile
+	for _, line := range strings.Split(string(data), "\n") {
+		f := strings.Fields(line)
+		if len(f) == 0 || strings.HasPrefix(f[0], "#") {
+			continue
+		}
+		var e aofFile
+		for i := 0; i+1 < len(f); i += 2 {
+			switch f[i] {
+			case "file":
+				e.Name = f[i+1]
+			case "seq":
+				e.Seq, _ = strconv.Atoi(f[i+1])
+			case "type":
+				e.Type = f[i+1]
+			}
+		}
+		if e.Name == "" || e.Name != filepath.Base(e.Name) {
+			return nil, fmt.Errorf("%s: bad line %q", path, line)
+		}
+		out = append(out, e)
+	}
+	return out, nil
+}
+
+func writeAOFManifest(path string, files []aofFile) error {
+	var b strings.Builder
+	for _, f := range files {
+		fmt.Fprintf(&b, "file %s seq %d type %s\n", f.Name, f.Seq, f.Type)
+	}
+	return writeFileAtomic(path, []byte(b.String()), 0644)
+}
+
+/*************** ARCHIVE ***************/
+
+// archiveAOF copies new and grown AOF files of an instance. The base of a
+// generation never changes; the open increment only grows, so whatever it
+// gained since the last run is appended to the archived copy.
+func archiveAOF(port, host string) error {
+	if getRedisConfig(port, "appendonly") != "yes" {
+		return errors.New("appendonly is off")
+	}
+	dirName := getRedisConfig(port, "appenddirname")
+	if dirName == "" {
+		return errors.New("no appenddirname: point-in-time recovery needs Redis 7 multi-part AOF")
+	}
+	if getRedisConfig(port, "aof-timestamp-enabled") != "yes" {
+		log.Printf("%s⚠  Redis %s: aof-timestamp-enabled is off, the AOF can only be replayed as a whole%s", yellow, port, reset)
+	}
+	src := filepath.Join(getRedisDir(port), dirName)
+	files, err := parseAOFManifest(filepath.Join(src, getRedisConfig(port, "appendfilename")+".manifest"))
+	if err != nil {
+		return err
+	}
+
+	dst := filepath.Join(backupPath, host, backupSubdir, "redis_"+port, aofDirName)
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+	unlock, err := lockAOFDir(dst)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	var gen []aofFile
+	for _, f := range files {
+		from, to := filepath.Join(src, f.Name), filepath.Join(dst, f.Name)
+		di, derr := os.Stat(to)
+		if f.Type == "h" {
+			// replaced by a newer base; only catch up on the tail of an
+			// increment we were already copying when the rewrite happened
+			if derr != nil {
+				continue
+			}
+		} else {
+			gen = append(gen, f)
+		}
+		si, err := os.Stat(from)
+		if err != nil {
+			if f.Type == "h" {
+				continue // Redis already deleted it
+			}
+			return err
+		}
+		if derr == nil && (f.Type == "b" || di.Size() >= si.Size()) {
+			continue
+		}
+		if derr == nil {
+			err = appendTail(from, to, di.Size())
+		} else {
+			err = copyFile(from, to)
+		}
+		if err != nil {
+			return fmt.Errorf("copying %s: %w", f.Name, err)
+		}
+		_ = os.Chtimes(to, si.ModTime(), si.ModTime())
+		log.Printf("%s📼 Redis %s: %s (%.1f MB)%s", green, port, f.Name, humanMB(si.Size()), reset)
+	}
+	if len(gen) == 0 || gen[0].Type != "b" {
+		return errors.New("manifest has no base file")
+	}
+	if err := writeAOFManifest(filepath.Join(dst, gen[0].Name+".manifest"), gen); err != nil {
+		return err
+	}
+	pruneAOFGenerations(dst)
+	return nil
+}
+
+// appendTail appends what src gained beyond offset to dst. Increments only
+// grow, so the archived copy is a prefix of the live file; a crash mid-way
+// leaves a shorter prefix that the next run continues from.
+func appendTail(src, dst string, offset int64) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if _, err := in.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, in); err != nil {
+		return fmt.Errorf("append %s: %w", dst, err)
+	}
+	if err := out.Sync(); err != nil {
+		return fmt.Errorf("sync %s: %w", dst, err)
+	}
+	return out.Close()
+}
+
+// lockAOFDir keeps two archive-aof runs from copying into the same place.
+func lockAOFDir(dir string) (func(), error) {
+	f, err := os.OpenFile(filepath.Join(dir, ".lock"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		return nil, errors.New("previous archive-aof run still busy")
+	}
+	// leftovers of an interrupted copy
+	partials, _ := filepath.Glob(filepath.Join(dir, "*"+partialSuffix))
+	for _, p := range partials {
+		_ = os.Remove(p)
+	}
+	return func() { f.Close() }, nil
+}
+
+// aofGenerations lists the archived generations, oldest first.
+func aofGenerations(dir string) []aofGeneration {
+	manifests, _ := filepath.Glob(filepath.Join(dir, "*.manifest"))
+	var out []aofGeneration
+	for _, m := range manifests {
+		files, err := parseAOFManifest(m)
+		if err != nil || len(files) == 0 || files[0].Type != "b" {
+			continue
+		}
+		info, err := os.Stat(filepath.Join(dir, files[0].Name))
+		if err != nil {
+			continue
+		}
+		out = append(out, aofGeneration{Base: files[0], Incrs: files[1:], BaseTime: info.ModTime()})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Base.Seq < out[j].Base.Seq })
+	return out
+}
+
+// pruneAOFGenerations drops generations whose base is older than --days,
+// always keeping the newest one.
+func pruneAOFGenerations(dir string) {
+	gens := aofGenerations(dir)
+	cutoff := time.Now().AddDate(0, 0, -keepDays)
+	for i, g := range gens {
+		if i == len(gens)-1 || !g.BaseTime.Before(cutoff) {
+			continue
+		}
+		for _, f := range append([]aofFile{g.Base}, g.Incrs...) {
+			logRemoval("old AOF", filepath.Join(dir, f.Name))
+			_ = os.Remove(filepath.Join(dir, f.Name))
+		}
+		_ = os.Remove(filepath.Join(dir, g.Base.Name+".manifest"))
+	}
+}
+
+func cmdArchiveAOF(args []string) int {
+	host, _ := os.Hostname()
+	ports := []string{targetPort}
+	if targetPort == "" {
+		ports = nil
+		for _, p := range detectRedisPorts() {
+			if _, skip := excludePorts[p]; !skip {
+				ports = append(ports, p)
+			}
+		}
+	}
+	failed := 0
+	for _, port := range ports {
+		if err := archiveAOF(port, host); err != nil {
+			suggestSudo(err)
+			log.Printf("%sRedis %s: AOF not archived: %v%s", red, port, err, reset)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return 2
+	}
+	return 0
+}
+
+/*************** REPLAY ***************/
+
+// truncateAOF copies an AOF up to the first "#TS:" annotation later than
+// until. It returns the last timestamp copied and whether it stopped early.
+// An incomplete command at the end (file copied while Redis wrote it) is
+// dropped.
+func truncateAOF(r io.Reader, w io.Writer, until int64) (int64, bool, error) {
+	br := bufio.NewReaderSize(r, 1<<20)
+	var last int64
+	var cmd []byte
+	for {
+		b, err := br.Peek(1)
+		if err == io.EOF {
+			return last, false, nil
+		}
+		if err != nil {
+			return last, false, err
+		}
+		switch b[0] {
+		case '#':
+			line, err := br.ReadBytes('\n')
+			if err != nil {
+				return last, false, nil // incomplete
+			}
+			if ts, ok := strings.CutPrefix(strings.TrimSpace(string(line)), "#TS:"); ok {
+				t, _ := strconv.ParseInt(ts, 10, 64)
+				if t > until {
+					return last, true, nil
+				}
+				last = t
+			}
+			if _, err := w.Write(line); err != nil {
+				return last, false, err
+			}
+		case '*':
+			cmd, err = readAOFCommand(br, cmd[:0])
+			if err == io.ErrUnexpectedEOF {
+				return last, false, nil
+			}
+			if err != nil {
+				return last, false, err
+			}
+			if _, err := w.Write(cmd); err != nil {
+				return last, false, err
+			}
+		default:
+			return last, false, fmt.Errorf("unexpected byte %q in AOF", b[0])
+		}
+	}
+}
+
+// readAOFCommand reads one "*<n>\r\n$<len>\r\n…" command verbatim.
+func readAOFCommand(br *bufio.Reader, buf []byte) ([]byte, error) {
+	line := func() (string, error) {
+		l, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		buf = append(buf, l...)
+		return strings.TrimRight(string(l), "\r\n"), err
+	}
+	head, err := line()
+	if err != nil {
+		return buf, err
+	}
+	n, err := strconv.Atoi(head[1:])
+	if err != nil {
+		return buf, fmt.Errorf("bad AOF command header %q", head)
+	}
+	for i := 0; i < n; i++ {
+		h, err := line()
+		if err != nil {
+			return buf, err
+		}
+		if !strings.HasPrefix(h, "$") {
+			return buf, fmt.Errorf("bad AOF argument header %q", h)
+		}
+		size, err := strconv.Atoi(h[1:])
+		if err != nil {
+			return buf, err
+		}
+		start := len(buf)
+		buf = append(buf, make([]byte, size+2)...)
+		if _, err := io.ReadFull(br, buf[start:]); err != nil {
+			return buf, io.ErrUnexpectedEOF
+		}
+	}
+	return buf, nil
+}
+
+// buildPITRDir prepares dir/aof with the base of the right generation and
+// one increment holding everything up to at. It returns the time the data
+// actually reaches.
+func buildPITRDir(aofDir, dir string, at time.Time) (time.Time, error) {
+	gens := aofGenerations(aofDir)
+	var gen *aofGeneration
+	for i := range gens {
+		if !gens[i].BaseTime.After(at) {
+			gen = &gens[i]
+		}
+	}
+	if gen == nil {
+		if len(gens) == 0 {
+			return time.Time{}, fmt.Errorf("no archived AOF in %s (run archive-aof)", aofDir)
+		}
+		return time.Time{}, fmt.Errorf("oldest archived AOF base is from %s", gens[0].BaseTime.Format("2006-01-02 15:04:05"))
+	}
+
+	work := filepath.Join(dir, aofDirName)
+	if err := os.MkdirAll(work, 0755); err != nil {
+		return time.Time{}, err
+	}
+	baseName := "appendonly.aof.1.base" + filepath.Ext(gen.Base.Name)
+	if err := linkOrCopy(filepath.Join(aofDir, gen.Base.Name), filepath.Join(work, baseName)); err != nil {
+		return time.Time{}, err
+	}
+
+	out, err := os.Create(filepath.Join(work, "appendonly.aof.1.incr.aof"))
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer out.Close()
+	w := bufio.NewWriterSize(out, 1<<20)
+	reached := gen.BaseTime
+	for _, f := range gen.Incrs {
+		in, err := os.Open(filepath.Join(aofDir, f.Name))
+		if err != nil {
+			return time.Time{}, err
+		}
+		last, cut, err := truncateAOF(in, w, at.Unix())
+		in.Close()
+		if err != nil {
+			return time.Time{}, fmt.Errorf("%s: %w", f.Name, err)
+		}
+		if last > 0 {
+			reached = time.Unix(last, 0)
+		}
+		if cut {
+			reached = at
+			break
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return time.Time{}, err
+	}
+	if err := out.Close(); err != nil {
+		return time.Time{}, err
+	}
+	return reached, writeAOFManifest(filepath.Join(work, "appendonly.aof.manifest"), []aofFile{
+		{Name: baseName, Seq: 1, Type: "b"},
+		{Name: "appendonly.aof.1.incr.aof", Seq: 1, Type: "i"},
+	})
+}
+
+/*************** PITR ***************/
+
+// parseTimeArg accepts the usual ways to write a local time, the archive
+// timestamp format and unix seconds.
+func parseTimeArg(s string) (time.Time, error) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil && n > 100000000 {
+		return time.Unix(n, 0), nil
+	}
+	for _, layout := range []string{
+		"2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02T15:04:05",
+		"2006-01-02T15:04", "2006-01-02_15-04-05", "2006-01-02",
+	} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("cannot parse time %q (use \"2006-01-02 15:04:05\")", s)
+}
+
+func cmdPITR(args []string) int {
+	if targetPort == "" || atTime == "" || (outputFile == "" && intoPort == "") {
+		fmt.Fprintf(os.Stderr, "%spitr: needs --port, --at and --output and/or --target-port%s\n", red, reset)
+		return 2
+	}
+	at, err := parseTimeArg(atTime)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%spitr: %v%s\n", red, err, reset)
+		return 2
+	}
+	if v, err := redisServerBinaryVersion(); err != nil || maxRDBVersion(v) < 10 {
+		fmt.Fprintf(os.Stderr, "%spitr: needs redis-server 7 or newer (--redis-server): %s %v%s\n", red, v, err, reset)
+		return 2
+	}
+
+	dir, err := os.MkdirTemp("", "redis-backup-pitr-")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s%v%s\n", red, err, reset)
+		return 2
+	}
+	defer os.RemoveAll(dir)
+
+	aofDir := filepath.Join(sourceBackupRoot(), "redis_"+targetPort, aofDirName)
+	reached, err := buildPITRDir(aofDir, dir, at)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%spitr: %v%s\n", red, err, reset)
+		return 2
+	}
+	if reached.Before(at) {
+		fmt.Printf("%s⚠  The archived AOF ends at %s; restoring up to there%s\n",
+			yellow, reached.Format("2006-01-02 15:04:05"), reset)
+	}
+	fmt.Printf("Replaying Redis %s up to %s in a sandbox …\n", targetPort, at.Format("2006-01-02 15:04:05"))
+
+	sb, err := startSandbox(dir, "--appendonly", "yes", "--appenddirname", aofDirName,
+		"--appendfilename", "appendonly.aof", "--aof-load-truncated", "yes",
+		"--auto-aof-rewrite-percentage", "0")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s%v%s\n", red, err, reset)
+		return 2
+	}
+	defer sb.stop()
+	if err := sb.waitLoaded(time.Duration(loadTimeoutSec) * time.Second); err != nil {
+		fmt.Fprintf(os.Stderr, "%spitr: %v%s\n", red, err, reset)
+		return 2
+	}
+	c, err := dialRedis(sb.Port)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s%v%s\n", red, err, reset)
+		return 2
+	}
+	defer c.Close()
+	keyspace, _ := loadedKeyspace(c)
+	var keys int64
+	for _, db := range keyspace {
+		keys += db.Keys
+	}
+	fmt.Printf("%s✔ Dataset at %s: %d keys%s\n", green, reached.Format("2006-01-02 15:04:05"), keys, reset)
+
+	if outputFile != "" {
+		if _, err := c.do("SAVE"); err != nil {
+			fmt.Fprintf(os.Stderr, "%sSAVE: %v%s\n", red, err, reset)
+			return 2
+		}
+		if err := copyFile(filepath.Join(dir, "dump.rdb"), outputFile); err != nil {
+			fmt.Fprintf(os.Stderr, "%sCannot write %s: %v%s\n", red, outputFile, err, reset)
+			return 2
+		}
+		fmt.Printf("%s✔ RDB written to %s%s\n", green, outputFile, reset)
+	}
+
+	if intoPort != "" {
+		if err := checkDumpCompat(sb.Port, intoPort); err != nil {
+			fmt.Fprintf(os.Stderr, "%sRefusing to restore: %v (--force-version to override)%s\n", red, err, reset)
+			return 2
+		}
+		n, err := copyDataset(c, intoPort, keyspace)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%sRedis %s: %v (%d keys copied)%s\n", red, intoPort, err, n, reset)
+			return 2
+		}
+		fmt.Printf("%s✔ %d keys written into Redis %s%s\n", green, n, intoPort, reset)
+	}
+	return 0
+}
+
+// checkDumpCompat makes sure DUMP payloads of one server can be RESTOREd
+// on the other.
+func checkDumpCompat(fromPort, toPort string) error {
+	from, err1 := targetRedisVersion(fromPort)
+	to, err2 := targetRedisVersion(toPort)
+	if err1 != nil || err2 != nil || forceVersion {
+		return nil
+	}
+	if maxRDBVersion(from) > maxRDBVersion(to) {
+		return fmt.Errorf("data of Redis %s cannot be restored into Redis %s", from, to)
+	}
+	return nil
+}
+
+// copyDataset moves every key of the sandbox into a live instance with
+// DUMP / RESTORE … REPLACE, keeping TTLs. Other keys of the target stay.
+func copyDataset(src *redisConn, port string, keyspace map[string]dbSummary) (int64, error) {
+	dst, err := dialRedis(port)
+	if err != nil {
+		return 0, err
+	}
+	defer dst.Close()
+
+	var copied int64
+	for db := range keyspace {
+		if _, err := src.do("SELECT", db); err != nil {
+			return copied, err
+		}
+		if _, err := dst.do("SELECT", db); err != nil {
+			return copied, err
+		}
+		cursor := "0"
+		for {
+			reply, err := src.do("SCAN", cursor, "COUNT", 1000)
+			if err != nil {
+				return copied, err
+			}
+			parts, _ := reply.([]interface{})
+			if len(parts) != 2 {
+				return copied, errors.New("unexpected SCAN reply")
+			}
+			next, _ := parts[0].([]byte)
+			keys, _ := parts[1].([]interface{})
+			for _, k := range keys {
+				key, _ := k.([]byte)
+				payload, err := src.do("DUMP", key)
+				if err != nil {
+					return copied, err
+				}
+				if payload == nil {
+					continue // expired meanwhile
+				}
+				ttl, err := src.do("PTTL", key)
+				if err != nil {
+					return copied, err
+				}
+				ms, _ := ttl.(int64)
+				if ms == -2 {
+					continue
+				}
+				if ms < 0 {
+					ms = 0
+				}
+				if _, err := dst.do("RESTORE", key, ms, payload.([]byte), "REPLACE"); err != nil {
+					return copied, fmt.Errorf("RESTORE %s: %w", displayKey(key), err)
+				}
+				copied++
+			}
+			if cursor = string(next); cursor == "0" {
+				break
+			}
+		}
+	}
+	return copied, nil
+}
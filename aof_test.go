@@ -0,0 +1,109 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTruncateAOF(t *testing.T) {
+	const (
+		set1 = "*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\n1\r\n"
+		set2 = "*3\r\n$3\r\nSET\r\n$1\r\nb\r\n$1\r\n2\r\n"
+	)
+	tests := []struct {
+		name    string
+		in      string
+		until   int64
+		want    string
+		last    int64
+		stopped bool
+		err     bool
+	}{
+		{"no annotations", set1 + set2, 100, set1 + set2, 0, false, false},
+		{"everything before until", "#TS:10\r\n" + set1 + "#TS:20\r\n" + set2, 100,
+			"#TS:10\r\n" + set1 + "#TS:20\r\n" + set2, 20, false, false},
+		{"stops at a later second", "#TS:10\r\n" + set1 + "#TS:20\r\n" + set2, 15,
+			"#TS:10\r\n" + set1, 10, true, false},
+		{"until is inclusive", "#TS:10\r\n" + set1 + "#TS:20\r\n" + set2, 20,
+			"#TS:10\r\n" + set1 + "#TS:20\r\n" + set2, 20, false, false},
+		{"incomplete command dropped", "#TS:10\r\n" + set1 + set2[:len(set2)-4], 100,
+			"#TS:10\r\n" + set1, 10, false, false},
+		{"incomplete annotation dropped", set1 + "#TS:1", 100, set1, 0, false, false},
+		{"binary value with CRLF", "*2\r\n$3\r\nGET\r\n$4\r\n\r\n\r\n\r\n", 100,
+			"*2\r\n$3\r\nGET\r\n$4\r\n\r\n\r\n\r\n", 0, false, false},
+		{"garbage", "+OK\r\n", 100, "", 0, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			last, stopped, err := truncateAOF(strings.NewReader(tt.in), &out, tt.until)
+			if tt.err != (err != nil) {
+				t.Fatalf("err = %v, want error %v", err, tt.err)
+			}
+			if tt.err {
+				return
+			}
+			if out.String() != tt.want {
+				t.Errorf("output %q, want %q", out.String(), tt.want)
+			}
+			if last != tt.last || stopped != tt.stopped {
+				t.Errorf("last, stopped = %d, %v, want %d, %v", last, stopped, tt.last, tt.stopped)
+			}
+		})
+	}
+}
+
+func TestParseAOFManifest(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want []aofFile
+		err  bool
+	}{
+		{"base and increment", "file appendonly.aof.1.base.rdb seq 1 type b\nfile appendonly.aof.1.incr.aof seq 1 type i\n",
+			[]aofFile{{"appendonly.aof.1.base.rdb", 1, "b"}, {"appendonly.aof.1.incr.aof", 1, "i"}}, false},
+		{"comments and blank lines", "# written by redis\n\nfile appendonly.aof.2.base.rdb seq 2 type b\n",
+			[]aofFile{{"appendonly.aof.2.base.rdb", 2, "b"}}, false},
+		{"path in name", "file ../../etc/passwd seq 1 type b\n", nil, true},
+		{"missing name", "seq 1 type b\n", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "appendonly.aof.manifest")
+			if err := os.WriteFile(path, []byte(tt.in), 0644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := parseAOFManifest(path)
+			if tt.err != (err != nil) {
+				t.Fatalf("err = %v, want error %v", err, tt.err)
+			}
+			if !tt.err && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAppendTail(t *testing.T) {
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	if err := os.WriteFile(src, []byte("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dst, []byte("0123"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := appendTail(src, dst, 4); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(dst); string(got) != "0123456789" {
+		t.Fatalf("dst = %q, want the whole source", got)
+	}
+}
@@ -0,0 +1,213 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+/********************** ARCHIVE ACCESS **********************/
+// Reading the dump back out of a backup archive. An archive holds exactly
+// one RDB (plus directories); anything else a tar can carry is refused
+// before a byte of it is used.
+
+// archivedRDB is the RDB stream stored inside a backup archive.
+type archivedRDB struct {
+	io.Reader
+	Name    string
+	Size    int64
+	closers []io.Closer
+}
+
+func (a *archivedRDB) Close() error {
+	for i := len(a.closers) - 1; i >= 0; i-- {
+		a.closers[i].Close()
+	}
+	return nil
+}
+
+// checkTarEntry rejects entries a backup archive never holds: anything but
+// plain files and directories, and names that would leave the directory.
+func checkTarEntry(hdr *tar.Header) error {
+	switch hdr.Typeflag {
+	case tar.TypeReg, tar.TypeDir, tar.TypeXGlobalHeader:
+	case tar.TypeSymlink, tar.TypeLink:
+		return fmt.Errorf("archive holds a link %q -> %q", hdr.Name, hdr.Linkname)
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		return fmt.Errorf("archive holds a device or fifo %q", hdr.Name)
+	default:
+		return fmt.Errorf("archive holds an entry of type %q: %q", hdr.Typeflag, hdr.Name)
+	}
+	if path.IsAbs(hdr.Name) {
+		return fmt.Errorf("archive holds an absolute path %q", hdr.Name)
+	}
+	for _, part := range strings.Split(hdr.Name, "/") {
+		if part == ".." {
+			return fmt.Errorf("archive holds a path outside its directory %q", hdr.Name)
+		}
+	}
+	return nil
+}
+
+// checkArchiveEntries walks the headers of an archive: every entry must pass
+// checkTarEntry and exactly one must be a file, the RDB.
+func checkArchiveEntries(path string) error {
+	f, err := openArchive(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer gr.Close()
+	tr := tar.NewReader(gr)
+	files := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := checkTarEntry(hdr); err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			if files++; files > 1 {
+				return fmt.Errorf("archive holds more than one file: %q", hdr.Name)
+			}
+		}
+	}
+	if files == 0 {
+		return errors.New("archive contains no RDB file")
+	}
+	return nil
+}
+
+// tarEntryReader reads the dump and, at its end, makes sure nothing but
+// directories follows it: an archive holds exactly one RDB. The end (or
+// the error) is sticky, so read-ahead cannot move on to the next entry.
+type tarEntryReader struct {
+	tr  *tar.Reader
+	err error
+}
+
+func (r *tarEntryReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	n, err := r.tr.Read(p)
+	if err == io.EOF {
+		err = r.checkRest()
+	}
+	r.err = err
+	return n, err
+}
+
+func (r *tarEntryReader) checkRest() error {
+	for {
+		hdr, err := r.tr.Next()
+		if err != nil {
+			return err // io.EOF at the end of the archive
+		}
+		if err := checkTarEntry(hdr); err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			return fmt.Errorf("archive holds more than one file: %q", hdr.Name)
+		}
+	}
+}
+
+// openArchivedRDB positions a reader on the dump inside a (possibly split)
+// archive. Every entry up to and after the dump is checked with
+// checkTarEntry; the dump's name, owner and mode in the archive are not used.
+func openArchivedRDB(path string) (*archivedRDB, error) {
+	f, err := openArchive(path)
+	if err != nil {
+		return nil, err
+	}
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			gr.Close()
+			f.Close()
+			if err == io.EOF {
+				return nil, errors.New("archive contains no RDB file")
+			}
+			return nil, err
+		}
+		if err := checkTarEntry(hdr); err != nil {
+			gr.Close()
+			f.Close()
+			return nil, err
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			return &archivedRDB{Reader: &tarEntryReader{tr: tr}, Name: hdr.Name, Size: hdr.Size, closers: []io.Closer{f, gr}}, nil
+		}
+	}
+}
+
+// extractRDB writes the RDB stored in an archive to dst. Only the dump is
+// taken from the archive (see openArchivedRDB); it goes to a new temp file
+// next to dst, is checked against the signed checksum (or the one in .meta),
+// synced and then renamed into place, so dst is either the complete dump or untouched. The
+// file is created 0600 by the current user; callers set owner and mode.
+func extractRDB(src, dst string) error {
+	a, err := openArchivedRDB(src)
+	if err != nil {
+		suggestSudo(err)
+		return err
+	}
+	defer a.Close()
+
+	tmp := dst + partialSuffix
+	_ = os.Remove(tmp)
+	// O_EXCL: never write through something planted at the temp name
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		suggestSudo(err)
+		return err
+	}
+	defer os.Remove(tmp) // no-op once renamed
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(out, h), a); err != nil {
+		out.Close()
+		return err
+	}
+	if want, source := expectedRDBSHA256(src); want != "" && hex.EncodeToString(h.Sum(nil)) != want {
+		out.Close()
+		return fmt.Errorf("extracted RDB does not match the checksum in %s", source)
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(dst))
+}
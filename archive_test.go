@@ -0,0 +1,168 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testEntry is one tar entry of a crafted archive.
+type testEntry struct {
+	hdr  tar.Header
+	body []byte
+}
+
+func regularEntry(name string, body []byte) testEntry {
+	return testEntry{hdr: tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(body))}, body: body}
+}
+
+func writeTestArchive(t *testing.T, entries ...testEntry) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "2024-01-02_03-04-05_redis_6379.tar.gz")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gw := gzip.NewWriter(f)
+	tw := tar.NewWriter(gw)
+	for _, e := range entries {
+		hdr := e.hdr
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(e.body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCheckArchiveEntries(t *testing.T) {
+	rdb := regularEntry("var/lib/redis/dump.rdb", emptyRDB())
+	special := func(name string, typ byte, link string) testEntry {
+		return testEntry{hdr: tar.Header{Name: name, Typeflag: typ, Linkname: link, Mode: 0o644}}
+	}
+	tests := []struct {
+		name    string
+		entries []testEntry
+		wantErr string // "" = accepted
+	}{
+		{"single rdb", []testEntry{rdb}, ""},
+		{"directory and rdb", []testEntry{special("var/lib/redis/", tar.TypeDir, ""), rdb}, ""},
+		{"absolute path", []testEntry{regularEntry("/var/lib/redis/dump.rdb", emptyRDB())}, "absolute path"},
+		{"dot-dot", []testEntry{regularEntry("redis/../../etc/dump.rdb", emptyRDB())}, "outside its directory"},
+		{"symlink", []testEntry{special("dump.rdb", tar.TypeSymlink, "/etc/passwd")}, "link"},
+		{"hardlink", []testEntry{rdb, special("other.rdb", tar.TypeLink, "var/lib/redis/dump.rdb")}, "link"},
+		{"char device", []testEntry{special("null", tar.TypeChar, ""), rdb}, "device or fifo"},
+		{"fifo", []testEntry{rdb, special("pipe", tar.TypeFifo, "")}, "device or fifo"},
+		{"two files", []testEntry{rdb, regularEntry("other.rdb", emptyRDB())}, "more than one file"},
+		{"no file", []testEntry{special("var/lib/redis/", tar.TypeDir, "")}, "no RDB file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkArchiveEntries(writeTestArchive(t, tt.entries...))
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Fatalf("got %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// writeTestMeta stores a .meta with the given RDB checksum next to archive.
+func writeTestMeta(t *testing.T, archive, sum string) {
+	t.Helper()
+	data, _ := json.Marshal(backupMeta{RDBSHA256: sum})
+	if err := os.WriteFile(archive+".meta", data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExtractRDBChecksum(t *testing.T) {
+	sum := sha256.Sum256(emptyRDB())
+	good, bad := hex.EncodeToString(sum[:]), strings.Repeat("0", 64)
+	tests := []struct {
+		name     string
+		signWith string // .meta checksum at signing time, "" = unsigned
+		meta     string // .meta checksum at extraction, "" = none
+		wantErr  string
+	}{
+		{"no checksum", "", "", ""},
+		{"meta matches", "", good, ""},
+		{"meta differs", "", bad, "checksum in .meta"},
+		{"signed checksum matches", good, good, ""},
+		{"signed checksum wins over meta", bad, good, "checksum in the signed manifest"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			archive := writeTestArchive(t, regularEntry("dump.rdb", emptyRDB()))
+			if tt.signWith != "" {
+				useTestSigningKey(t)
+				writeTestMeta(t, archive, tt.signWith)
+				if err := signArchive(archive, "host", "6379"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.meta != "" {
+				writeTestMeta(t, archive, tt.meta)
+			}
+			dst := filepath.Join(t.TempDir(), "dump.rdb")
+			err := extractRDB(archive, dst)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Fatalf("got %v, want an error containing %q", err, tt.wantErr)
+			}
+			if _, serr := os.Stat(dst); (serr == nil) != (tt.wantErr == "") {
+				t.Fatalf("dst exists = %v after err = %v", serr == nil, err)
+			}
+		})
+	}
+}
+
+func TestArchiveReadersRejectHostileIndex(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "daily")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// the victim is a valid archive, so only the name check can stop a read
+	victim := writeTestArchive(t, regularEntry("dump.rdb", emptyRDB()))
+	if err := os.Rename(victim, filepath.Join(root, "victim")); err != nil {
+		t.Fatal(err)
+	}
+	archive := filepath.Join(dir, "2025-01-01_03-00-00_redis_6379.tar.gz")
+	data, _ := json.Marshal(volumeIndex{Parts: []volumePart{{Name: "../victim", Size: 1}}})
+	if err := os.WriteFile(archive+volumeIndexSuffix, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkArchiveEntries(archive); err == nil {
+		t.Error("checkArchiveEntries followed the index out of its directory")
+	}
+	if _, err := verifyArchiveRDB(archive); err == nil {
+		t.Error("verifyArchiveRDB followed the index out of its directory")
+	}
+	if err := extractRDB(archive, filepath.Join(t.TempDir(), "dump.rdb")); err == nil {
+		t.Error("extractRDB followed the index out of its directory")
+	}
+}
@@ -0,0 +1,239 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+/********************** COMMANDS **********************/
+// Besides the flag-driven modes the tool understands sub-commands that work
+// on archives:  redis-backup <command> [flags] <args…>. Flags may appear
+// before or after the command and share the global flag set.
+
+// parseCommandLine re-parses what flag.Parse left over so flags can follow
+// the command and its arguments. It returns the positional arguments.
+func parseCommandLine(args []string) []string {
+	var positional []string
+	for len(args) > 0 {
+		_ = flag.CommandLine.Parse(args) // ExitOnError
+		args = flag.Args()
+		if len(args) == 0 {
+			break
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+	return positional
+}
+
+// runCommand executes a sub-command and returns the process exit code.
+func runCommand(args []string) int {
+	switch args[0] {
+	case "verify":
+		return cmdVerify(args[1:])
+	case "diff":
+		return cmdDiff(args[1:])
+	case "export":
+		return cmdExport(args[1:])
+	case "restore-keys":
+		return cmdRestoreKeys(args[1:])
+	case "test-restore":
+		return cmdTestRestore(args[1:])
+	case "report":
+		return cmdReport(args[1:])
+	case "archive-aof":
+		return cmdArchiveAOF(args[1:])
+	case "pitr":
+		return cmdPITR(args[1:])
+	case "restore":
+		return cmdRestore(args[1:])
+	case "rollback":
+		return cmdRollback(args[1:])
+	}
+	fmt.Fprintf(os.Stderr, "%sUnknown command %q (see --help)%s\n", red, args[0], reset)
+	return 2
+}
+
+/*************** ARCHIVE LOOKUP ***************/
+
+var archiveNameRe = regexp.MustCompile(`_redis_(\d+)\.tar\.gz$`)
+
+// hostBackupRoot is <backup-path>/<host>/redis-backup of this machine.
+func hostBackupRoot() string {
+	host, _ := os.Hostname()
+	return backupRootOf(host)
+}
+
+// backupRootOf is the local backup tree of host.
+func backupRootOf(host string) string {
+	return filepath.Join(backupPath, host, backupSubdir)
+}
+
+// sourceHostName is the host whose backups are listed and restored: this
+// machine, or --source-host when restoring another host's backups (e.g. on
+// the replacement of a server).
+func sourceHostName() string {
+	if sourceHost != "" {
+		return sourceHost
+	}
+	host, _ := os.Hostname()
+	return host
+}
+
+// sourceBackupRoot is the local backup tree of the source host.
+func sourceBackupRoot() string {
+	return backupRootOf(sourceHostName())
+}
+
+// backupHosts lists the hosts that have a backup tree under --backup-path.
+func backupHosts() []string {
+	entries, _ := os.ReadDir(backupPath)
+	var hosts []string
+	for _, e := range entries {
+		if e.IsDir() {
+			if info, err := os.Stat(backupRootOf(e.Name())); err == nil && info.IsDir() {
+				hosts = append(hosts, e.Name())
+			}
+		}
+	}
+	return hosts
+}
+
+// locateArchive turns a command argument into a logical archive path. It
+// accepts a path to an archive, its .parts index or an unchanged marker,
+// or just an archive file name, which is looked up in the instance's tiers.
+func locateArchive(arg string) (string, error) {
+	if strings.HasSuffix(arg, volumeIndexSuffix) {
+		arg = strings.TrimSuffix(arg, volumeIndexSuffix)
+	}
+	if strings.HasSuffix(arg, unchangedSuffix) {
+		m, err := readUnchangedMarker(arg)
+		if err != nil {
+			return "", err
+		}
+		arg = filepath.Join(filepath.Dir(arg), m.SameAs)
+	}
+	if archiveExists(arg) {
+		return arg, nil
+	}
+	if filepath.Base(arg) == arg {
+		if m := archiveNameRe.FindStringSubmatch(arg); m != nil {
+			for _, tier := range backupTiers {
+				p := filepath.Join(sourceBackupRoot(), "redis_"+m[1], tier, arg)
+				if archiveExists(p) {
+					return p, nil
+				}
+			}
+		}
+	}
+	return "", fmt.Errorf("archive %s not found", arg)
+}
+
+// dailyArchives lists the daily archives of an instance of --source-host,
+// oldest first.
+func dailyArchives(port string) []string {
+	dir := filepath.Join(sourceBackupRoot(), "redis_"+port, "daily")
+	var entries []retentionEntry
+	for _, e := range localRetentionEntries(dir) {
+		if !e.Marker {
+			entries = append(entries, e)
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Time.Before(entries[j].Time) })
+	out := make([]string, len(entries))
+	for i, e := range entries {
+		out[i] = filepath.Join(dir, e.Name)
+	}
+	return out
+}
+
+// backupTiers are the per-instance directories, newest data first.
+var backupTiers = []string{"daily", "weekly", "monthly", "yearly"}
+
+// collectArchives lists every archive below dir, sorted by path.
+func collectArchives(dir string) ([]string, error) {
+	seen := make(map[string]struct{})
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if name, ok := archiveLogicalName(d.Name()); ok {
+			seen[filepath.Join(filepath.Dir(path), name)] = struct{}{}
+		}
+		return nil
+	})
+	var out []string
+	for p := range seen {
+		out = append(out, p)
+	}
+	sort.Strings(out)
+	return out, err
+}
+
+/*************** VERIFY ***************/
+
+// cmdVerify parses archived dumps end to end: header, opcodes, every value
+// encoding and the trailing CRC64. Without arguments the whole backup tree
+// of this host is checked.
+func cmdVerify(args []string) int {
+	if len(args) == 0 {
+		args = []string{hostBackupRoot()}
+	}
+
+	var archives []string
+	for _, arg := range args {
+		if info, err := os.Stat(arg); err == nil && info.IsDir() {
+			found, err := collectArchives(arg)
+			if err != nil {
+				suggestSudo(err)
+				fmt.Printf("%sCannot scan %s: %v%s\n", red, arg, err, reset)
+				return 2
+			}
+			archives = append(archives, found...)
+			continue
+		}
+		path, err := locateArchive(arg)
+		if err != nil {
+			fmt.Printf("%sFAIL %s: %v%s\n", red, arg, err, reset)
+			return 2
+		}
+		archives = append(archives, path)
+	}
+	if len(archives) == 0 {
+		fmt.Printf("%sNo archives found.%s\n", yellow, reset)
+		return 1
+	}
+
+	failed := 0
+	for _, a := range archives {
+		info, err := verifyArchiveRDB(a)
+		if err != nil {
+			failed++
+			fmt.Printf("%sFAIL %s: %v%s\n", red, a, err, reset)
+			continue
+		}
+		crc := "CRC64 ok"
+		if info.Checksum == 0 {
+			crc = "no checksum stored"
+		}
+		fmt.Printf("%sOK   %s%s (RDB v%d, %d keys, %s)\n", green, a, reset, info.Version, info.Keys, crc)
+	}
+
+	fmt.Printf("%d archive(s) verified, %d failed\n", len(archives), failed)
+	if failed > 0 {
+		return 2
+	}
+	return 0
+}
@@ -0,0 +1,177 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/****************** RDB COMPATIBILITY ******************/
+// Redis loads dumps of its own RDB version and older ones only. A restore
+// from a newer server (say 7.2 → 6.2) is refused before anything is
+// touched, instead of leaving an instance that will not start.
+
+// maxRDBVersion is the newest RDB format a Redis release can load.
+//
+//	6 = 2.6–3.0   7 = 3.2   8 = 4.0   9 = 5.0/6.x
+//	10 = 7.0      11 = 7.2  12 = 7.4/8.x
+func maxRDBVersion(redisVersion string) int {
+	parts := strings.SplitN(redisVersion, ".", 3)
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0
+	}
+	minor := 0
+	if len(parts) > 1 {
+		minor, _ = strconv.Atoi(parts[1])
+	}
+	switch {
+	case major < 2 || major == 2 && minor < 6:
+		return 5
+	case major == 2 || major == 3 && minor < 2:
+		return 6
+	case major == 3:
+		return 7
+	case major == 4:
+		return 8
+	case major == 5 || major == 6:
+		return 9
+	case major == 7 && minor < 2:
+		return 10
+	case major == 7 && minor < 4:
+		return 11
+	}
+	return 12
+}
+
+var redisServerVersionRe = regexp.MustCompile(`v=(\d+\.\d+(\.\d+)?)`)
+
+// targetRedisVersion asks the running instance, or, when it is down, the
+// redis-server binary that would load the file.
+func targetRedisVersion(port string) (string, error) {
+	if c, err := dialRedis(port); err == nil {
+		defer c.Close()
+		if info, err := redisInfo(c, "server"); err == nil && info["redis_version"] != "" {
+			return info["redis_version"], nil
+		}
+	}
+	return redisServerBinaryVersion()
+}
+
+// redisServerBinaryVersion parses "Redis server v=7.2.4 sha=…".
+func redisServerBinaryVersion() (string, error) {
+	out, err := exec.Command(redisServerBin, "--version").Output()
+	if err != nil {
+		return "", fmt.Errorf("%s --version: %w", redisServerBin, err)
+	}
+	m := redisServerVersionRe.FindStringSubmatch(string(out))
+	if m == nil {
+		return "", fmt.Errorf("cannot parse %q", strings.TrimSpace(string(out)))
+	}
+	return m[1], nil
+}
+
+// loadedModules lists the modules of a running instance (MODULE LIST).
+func loadedModules(port string) (map[string]bool, error) {
+	c, err := dialRedis(port)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	reply, err := c.do("MODULE", "LIST")
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]bool)
+	list, _ := reply.([]interface{})
+	for _, m := range list {
+		fields, _ := m.([]interface{})
+		for i := 0; i+1 < len(fields); i += 2 {
+			if k, _ := fields[i].([]byte); string(k) == "name" {
+				v, _ := fields[i+1].([]byte)
+				out[strings.ToLower(string(v))] = true
+			}
+		}
+	}
+	return out, nil
+}
+
+// archiveKeyspace returns the stored keyspace summary, parsing the dump if
+// the archive predates summaries.
+func archiveKeyspace(path string) (*keyspaceSummary, error) {
+	if meta, err := readBackupMeta(path); err == nil && meta.Keyspace != nil {
+		return meta.Keyspace, nil
+	}
+	return summarizeArchive(path)
+}
+
+// checkRDBCompat compares the dump's RDB version with what the server
+// running (or to be started on) <port> can load; port "" means the
+// redis-server binary. It returns an error if the dump cannot be loaded
+// and warnings for module data.
+func checkRDBCompat(path, port string) ([]string, error) {
+	s, err := archiveKeyspace(path)
+	if err != nil {
+		return nil, err
+	}
+	var version string
+	if port != "" {
+		version, err = targetRedisVersion(port)
+	} else {
+		version, err = redisServerBinaryVersion()
+	}
+	if err != nil {
+		return []string{fmt.Sprintf("cannot determine target Redis version, RDB v%d not checked: %v", s.RDBVersion, err)}, nil
+	}
+
+	var warnings []string
+	if max := maxRDBVersion(version); s.RDBVersion > max {
+		from := ""
+		if s.RedisVersion != "" {
+			from = " (written by Redis " + s.RedisVersion + ")"
+		}
+		return nil, fmt.Errorf("RDB v%d%s cannot be loaded by Redis %s, which reads up to v%d",
+			s.RDBVersion, from, version, max)
+	}
+
+	if s.Types["module"] > 0 {
+		if len(s.Modules) == 0 {
+			warnings = append(warnings, fmt.Sprintf("%d keys hold module data; the target must load the same modules", s.Types["module"]))
+		} else if port == "" {
+			warnings = append(warnings, fmt.Sprintf("dump holds module data (%s)", strings.Join(s.Modules, ", ")))
+		} else if loaded, err := loadedModules(port); err != nil {
+			warnings = append(warnings, fmt.Sprintf("dump holds module data (%s); target modules unknown: %v",
+				strings.Join(s.Modules, ", "), err))
+		} else {
+			for _, m := range s.Modules {
+				if !loaded[strings.ToLower(moduleBaseName(m))] {
+					warnings = append(warnings, fmt.Sprintf("module %s is used in the dump but not loaded in Redis %s", m, port))
+				}
+			}
+		}
+	}
+	return warnings, nil
+}
+
+// moduleBaseName maps a module type name (ReJSON-RL, MBbloom--) to the
+// name MODULE LIST reports, where known.
+func moduleBaseName(typeName string) string {
+	switch {
+	case strings.HasPrefix(typeName, "ReJSON"):
+		return "ReJSON"
+	case strings.HasPrefix(typeName, "MBbloom"), strings.HasPrefix(typeName, "CMSk"), strings.HasPrefix(typeName, "TopK"):
+		return "bf"
+	case strings.HasPrefix(typeName, "ft_"):
+		return "search"
+	case strings.HasPrefix(typeName, "TSDB"):
+		return "timeseries"
+	case strings.HasPrefix(typeName, "graphdata"):
+		return "graph"
+	}
+	return typeName
+}
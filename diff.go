@@ -0,0 +1,279 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+/************************ DIFF ************************/
+// diff compares two archived dumps key by key. The older dump is kept in
+// memory as key → value digest; the newer one is streamed against it.
+
+type keyDigest struct {
+	Type   string
+	Digest uint64
+}
+
+type diffCounts struct {
+	Added, Removed, Changed, Same int64
+}
+
+// diffBucket groups the counters by database and data type.
+type diffBucket struct {
+	DB   int
+	Type string
+}
+
+// valueDigest hashes a decoded value in a canonical form, so the same data
+// stored with a different encoding (listpack vs hashtable …) compares equal.
+func valueDigest(e *rdbEntry) uint64 {
+	h := fnv.New64a()
+	put := func(b []byte) {
+		var n [8]byte
+		binary.LittleEndian.PutUint64(n[:], uint64(len(b)))
+		h.Write(n[:])
+		h.Write(b)
+	}
+	sortedPut := func(items [][]byte) {
+		s := make([]string, len(items))
+		for i, b := range items {
+			s[i] = string(b)
+		}
+		sort.Strings(s)
+		for _, x := range s {
+			put([]byte(x))
+		}
+	}
+
+	h.Write([]byte(rdbTypeName(e.Type)))
+	switch v := e.Value.(type) {
+	case []byte:
+		put(v)
+	case [][]byte:
+		if rdbTypeName(e.Type) == "set" {
+			sortedPut(v)
+		} else {
+			for _, b := range v {
+				put(b)
+			}
+		}
+	case []zsetMember:
+		items := make([][]byte, len(v))
+		for i, m := range v {
+			items[i] = append(append([]byte{}, m.Member...), []byte("\x00"+strconv.FormatUint(math.Float64bits(m.Score), 16))...)
+		}
+		sortedPut(items)
+	case []hashField:
+		items := make([][]byte, len(v))
+		for i, f := range v {
+			var buf []byte
+			buf = append(buf, f.Field...)
+			buf = append(buf, 0)
+			buf = append(buf, f.Value...)
+			items[i] = buf
+		}
+		sortedPut(items)
+	case *rdbStream:
+		for _, en := range v.Entries {
+			put([]byte(en.ID))
+			for _, kv := range en.Fields {
+				put(kv[0])
+				put(kv[1])
+			}
+		}
+	default:
+		put(e.Raw) // modules: only the serialized form is known
+	}
+	return h.Sum64()
+}
+
+// displayKey prints binary-safe keys readably.
+func displayKey(b []byte) string {
+	if utf8.Valid(b) {
+		printable := true
+		for _, r := range string(b) {
+			if r < 0x20 || r == 0x7f {
+				printable = false
+				break
+			}
+		}
+		if printable {
+			return string(b)
+		}
+	}
+	return strconv.Quote(string(b))
+}
+
+func diffMapKey(db int, key []byte) string {
+	return strconv.Itoa(db) + "\x00" + string(key)
+}
+
+func cmdDiff(args []string) int {
+	mode := outputFormat
+	if mode == "" {
+		mode = "summary"
+	}
+	if mode != "summary" && mode != "detailed" {
+		fmt.Fprintf(os.Stderr, "%sdiff: --format must be summary or detailed%s\n", red, reset)
+		return 2
+	}
+
+	oldPath, newPath, err := diffArguments(args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%sdiff: %v%s\n", red, err, reset)
+		return 2
+	}
+	fmt.Printf("%s--- %s%s\n%s+++ %s%s\n", red, oldPath, reset, green, newPath, reset)
+
+	// 1) older dump → digests
+	old := make(map[string]keyDigest)
+	a, err := openArchivedRDB(oldPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s%s: %v%s\n", red, oldPath, err, reset)
+		return 2
+	}
+	_, err = parseRDB(a, captureModules, func(e *rdbEntry) error {
+		old[diffMapKey(e.DB, e.Key)] = keyDigest{Type: rdbTypeName(e.Type), Digest: valueDigest(e)}
+		return nil
+	})
+	a.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s%s: %v%s\n", red, oldPath, err, reset)
+		return 2
+	}
+
+	// 2) stream the newer dump against it
+	counts := make(map[diffBucket]*diffCounts)
+	bucket := func(db int, typ string) *diffCounts {
+		k := diffBucket{DB: db, Type: typ}
+		if counts[k] == nil {
+			counts[k] = &diffCounts{}
+		}
+		return counts[k]
+	}
+	b, err := openArchivedRDB(newPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s%s: %v%s\n", red, newPath, err, reset)
+		return 2
+	}
+	_, err = parseRDB(b, captureModules, func(e *rdbEntry) error {
+		k := diffMapKey(e.DB, e.Key)
+		typ := rdbTypeName(e.Type)
+		prev, found := old[k]
+		delete(old, k)
+		switch {
+		case !found:
+			bucket(e.DB, typ).Added++
+			if mode == "detailed" {
+				fmt.Printf("%s+ db%d %-6s %s%s\n", green, e.DB, typ, displayKey(e.Key), reset)
+			}
+		case prev.Type != typ || prev.Digest != valueDigest(e):
+			bucket(e.DB, typ).Changed++
+			if mode == "detailed" {
+				note := ""
+				if prev.Type != typ {
+					note = " (was " + prev.Type + ")"
+				}
+				fmt.Printf("%s~ db%d %-6s %s%s%s\n", yellow, e.DB, typ, displayKey(e.Key), note, reset)
+			}
+		default:
+			bucket(e.DB, typ).Same++
+		}
+		return nil
+	})
+	b.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s%s: %v%s\n", red, newPath, err, reset)
+		return 2
+	}
+
+	// 3) whatever is left existed only in the older dump
+	var removed []string
+	for k := range old {
+		removed = append(removed, k)
+	}
+	sort.Strings(removed)
+	for _, k := range removed {
+		var db int
+		var key string
+		if i := strings.IndexByte(k, 0); i >= 0 {
+			db, _ = strconv.Atoi(k[:i])
+			key = k[i+1:]
+		}
+		bucket(db, old[k].Type).Removed++
+		if mode == "detailed" {
+			fmt.Printf("%s- db%d %-6s %s%s\n", red, db, old[k].Type, displayKey([]byte(key)), reset)
+		}
+	}
+
+	printDiffSummary(counts)
+	return 0
+}
+
+func printDiffSummary(counts map[diffBucket]*diffCounts) {
+	var keys []diffBucket
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].DB != keys[j].DB {
+			return keys[i].DB < keys[j].DB
+		}
+		return keys[i].Type < keys[j].Type
+	})
+
+	var total diffCounts
+	fmt.Printf("\n%s%-5s %-8s %10s %10s %10s %10s%s\n", cyan, "DB", "TYPE", "ADDED", "REMOVED", "CHANGED", "SAME", reset)
+	for _, k := range keys {
+		c := counts[k]
+		fmt.Printf("db%-3d %-8s %10d %10d %10d %10d\n", k.DB, k.Type, c.Added, c.Removed, c.Changed, c.Same)
+		total.Added += c.Added
+		total.Removed += c.Removed
+		total.Changed += c.Changed
+		total.Same += c.Same
+	}
+	fmt.Printf("%-14s %10d %10d %10d %10d\n", "total", total.Added, total.Removed, total.Changed, total.Same)
+}
+
+// diffArguments resolves "<old> <new>", "--port P <old>" (old vs newest)
+// or "--port P" (the two newest daily archives).
+func diffArguments(args []string) (string, string, error) {
+	var paths []string
+	for _, a := range args {
+		p, err := locateArchive(a)
+		if err != nil {
+			return "", "", err
+		}
+		paths = append(paths, p)
+	}
+	if len(paths) == 2 {
+		return paths[0], paths[1], nil
+	}
+	if len(paths) > 2 {
+		return "", "", fmt.Errorf("expected two archives, got %d", len(paths))
+	}
+	if targetPort == "" {
+		return "", "", fmt.Errorf("give two archives, or --port to use the newest daily ones")
+	}
+	daily := dailyArchives(targetPort)
+	if len(paths) == 1 {
+		if len(daily) == 0 {
+			return "", "", fmt.Errorf("no daily archives for port %s", targetPort)
+		}
+		return paths[0], daily[len(daily)-1], nil
+	}
+	if len(daily) < 2 {
+		return "", "", fmt.Errorf("port %s has fewer than two daily archives", targetPort)
+	}
+	return daily[len(daily)-2], daily[len(daily)-1], nil
+}
@@ -0,0 +1,309 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+/************************ EXPORT ************************/
+// export writes the keys of an archived dump either as JSON Lines (one
+// object per key) or as a RESP command stream for `redis-cli --pipe`.
+
+// jsonBytes is a binary-safe JSON value: a string when the data is valid
+// UTF-8, {"base64": "…"} otherwise.
+type jsonBytes []byte
+
+func (b jsonBytes) MarshalJSON() ([]byte, error) {
+	if utf8.Valid(b) {
+		return json.Marshal(string(b))
+	}
+	return json.Marshal(map[string]string{"base64": base64.StdEncoding.EncodeToString(b)})
+}
+
+type exportRecord struct {
+	DB       int         `json:"db"`
+	Key      jsonBytes   `json:"key"`
+	Type     string      `json:"type"`
+	TTL      int64       `json:"ttl"`                 // seconds left, -1 = persistent
+	ExpireAt int64       `json:"expire_at,omitempty"` // unix ms
+	Value    interface{} `json:"value"`
+}
+
+type exportScored struct {
+	Member jsonBytes `json:"member"`
+	Score  float64   `json:"score"`
+}
+
+type exportField struct {
+	Field    jsonBytes `json:"field"`
+	Value    jsonBytes `json:"value"`
+	ExpireAt int64     `json:"expire_at,omitempty"`
+}
+
+type exportStreamEntry struct {
+	ID     string         `json:"id"`
+	Fields [][2]jsonBytes `json:"fields"`
+}
+
+// exportValue turns a decoded value into its JSON shape.
+func exportValue(e *rdbEntry) interface{} {
+	switch v := e.Value.(type) {
+	case []byte:
+		return jsonBytes(v)
+	case [][]byte:
+		out := make([]jsonBytes, len(v))
+		for i, b := range v {
+			out[i] = b
+		}
+		return out
+	case []zsetMember:
+		out := make([]exportScored, len(v))
+		for i, m := range v {
+			out[i] = exportScored{Member: m.Member, Score: m.Score}
+		}
+		return out
+	case []hashField:
+		out := make([]exportField, len(v))
+		for i, f := range v {
+			out[i] = exportField{Field: f.Field, Value: f.Value, ExpireAt: f.ExpireMs}
+		}
+		return out
+	case *rdbStream:
+		entries := make([]exportStreamEntry, len(v.Entries))
+		for i, en := range v.Entries {
+			fields := make([][2]jsonBytes, len(en.Fields))
+			for j, kv := range en.Fields {
+				fields[j] = [2]jsonBytes{kv[0], kv[1]}
+			}
+			entries[i] = exportStreamEntry{ID: en.ID, Fields: fields}
+		}
+		return map[string]interface{}{"last_id": v.LastID, "length": v.Length, "entries": entries}
+	case rdbModuleValue:
+		return map[string]string{"module": v.Module, "dump": base64.StdEncoding.EncodeToString(dumpPayload(e))}
+	}
+	return nil
+}
+
+func cmdExport(args []string) int {
+	format := outputFormat
+	if format == "" {
+		format = "jsonl"
+	}
+	if format != "jsonl" && format != "resp" {
+		fmt.Fprintf(os.Stderr, "%sexport: --format must be jsonl or resp%s\n", red, reset)
+		return 2
+	}
+
+	var path string
+	switch {
+	case len(args) == 1:
+		p, err := locateArchive(args[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%sexport: %v%s\n", red, err, reset)
+			return 2
+		}
+		path = p
+	case len(args) == 0 && targetPort != "":
+		daily := dailyArchives(targetPort)
+		if len(daily) == 0 {
+			fmt.Fprintf(os.Stderr, "%sexport: no daily archives for port %s%s\n", red, targetPort, reset)
+			return 2
+		}
+		path = daily[len(daily)-1]
+	default:
+		fmt.Fprintf(os.Stderr, "%sexport: give one archive, or --port for the newest daily one%s\n", red, reset)
+		return 2
+	}
+
+	a, err := openArchivedRDB(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s%s: %v%s\n", red, path, err, reset)
+		return 2
+	}
+	defer a.Close()
+
+	out := bufio.NewWriterSize(os.Stdout, 1<<20)
+	enc := json.NewEncoder(out)
+	enc.SetEscapeHTML(false)
+	now := time.Now().UnixMilli()
+	currentDB := -1
+	var exported, expired int64
+
+	capture := captureNone
+	if format == "resp" {
+		capture = captureAll
+	}
+	_, err = parseRDB(a, capture, func(e *rdbEntry) error {
+		if filterDB >= 0 && e.DB != filterDB {
+			return nil
+		}
+		if keyPattern != "" && !globMatch([]byte(keyPattern), e.Key) {
+			return nil
+		}
+		if e.ExpireMs > 0 && e.ExpireMs <= now {
+			expired++ // Redis would drop it on load as well
+			return nil
+		}
+		exported++
+		if format == "jsonl" {
+			rec := exportRecord{DB: e.DB, Key: e.Key, Type: rdbTypeName(e.Type), TTL: -1, Value: exportValue(e)}
+			if e.ExpireMs > 0 {
+				rec.TTL = (e.ExpireMs - now + 999) / 1000
+				rec.ExpireAt = e.ExpireMs
+			}
+			return enc.Encode(rec)
+		}
+		if e.DB != currentDB {
+			currentDB = e.DB
+			if err := writeRESPCommand(out, respArgs("SELECT", e.DB)...); err != nil {
+				return err
+			}
+		}
+		return writeRESPRestore(out, e)
+	})
+	if ferr := out.Flush(); err == nil {
+		err = ferr
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s%s: %v%s\n", red, path, err, reset)
+		return 2
+	}
+	fmt.Fprintf(os.Stderr, "%d key(s) exported from %s", exported, path)
+	if expired > 0 {
+		fmt.Fprintf(os.Stderr, ", %d already expired skipped", expired)
+	}
+	fmt.Fprintln(os.Stderr)
+	return 0
+}
+
+// writeRESPRestore emits the commands recreating one key: SET for strings,
+// DEL + HSET for plain hashes, RESTORE … REPLACE with a DUMP payload for
+// everything else. The TTL follows as PEXPIREAT.
+func writeRESPRestore(w *bufio.Writer, e *rdbEntry) error {
+	var err error
+	fields, isHash := e.Value.([]hashField)
+	for _, f := range fields {
+		if f.ExpireMs > 0 {
+			isHash = false // field TTLs only survive RESTORE
+		}
+	}
+	switch {
+	case rdbTypeName(e.Type) == "string":
+		err = writeRESPCommand(w, respArgs("SET", e.Key, e.Value.([]byte))...)
+	case isHash:
+		if err = writeRESPCommand(w, respArgs("DEL", e.Key)...); err != nil {
+			return err
+		}
+		const batch = 1000
+		for i := 0; i < len(fields) && err == nil; i += batch {
+			cmd := respArgs("HSET", e.Key)
+			for _, f := range fields[i:minInt(i+batch, len(fields))] {
+				cmd = append(cmd, f.Field, f.Value)
+			}
+			err = writeRESPCommand(w, cmd...)
+		}
+	default:
+		err = writeRESPCommand(w, respArgs("RESTORE", e.Key, "0", dumpPayload(e), "REPLACE")...)
+	}
+	if err == nil && e.ExpireMs > 0 {
+		err = writeRESPCommand(w, respArgs("PEXPIREAT", e.Key, strconv.FormatInt(e.ExpireMs, 10))...)
+	}
+	return err
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+/*************** KEY PATTERNS ***************/
+
+// globMatch implements Redis' glob syntax (KEYS / SCAN MATCH): * ? [abc]
+// [^a-z] and backslash escapes. Unlike path.Match, '/' is not special.
+func globMatch(pattern, s []byte) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if globMatch(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+			s = s[1:]
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			pattern = pattern[1:]
+			not := len(pattern) > 0 && pattern[0] == '^'
+			if not {
+				pattern = pattern[1:]
+			}
+			match := false
+			for len(pattern) > 0 && pattern[0] != ']' {
+				switch {
+				case pattern[0] == '\\' && len(pattern) >= 2:
+					pattern = pattern[1:]
+					if pattern[0] == s[0] {
+						match = true
+					}
+				case len(pattern) >= 3 && pattern[1] == '-':
+					lo, hi := pattern[0], pattern[2]
+					if lo > hi {
+						lo, hi = hi, lo
+					}
+					if s[0] >= lo && s[0] <= hi {
+						match = true
+					}
+					pattern = pattern[2:]
+				default:
+					if pattern[0] == s[0] {
+						match = true
+					}
+				}
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return false // unterminated class
+			}
+			if match == not {
+				return false
+			}
+			s = s[1:]
+		case '\\':
+			if len(pattern) >= 2 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || pattern[0] != s[0] {
+				return false
+			}
+			s = s[1:]
+		}
+		pattern = pattern[1:]
+	}
+	return len(s) == 0
+}
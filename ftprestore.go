@@ -0,0 +1,427 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jlaffaye/ftp"
+)
+
+/****************** FTP RESTORE ******************/
+// When the local backup disk is gone the FTP replicas are all that is left.
+// uploadToSingleFTP stores them like the local tree (<host>/redis-backup/
+// redis_<port>/<tier>/), so they are listed the same way, pulled into a temp
+// directory, checked against their checksums and restored as usual.
+
+// remoteArchive is an archive (or unchanged marker) on one FTP account.
+type remoteArchive struct {
+	Account ftpAccount
+	Dir     string // remote tier directory
+	Name    string
+	Tier    string
+	Time    time.Time
+	Size    int64
+	Marker  bool
+}
+
+func (r remoteArchive) String() string {
+	return "ftp://" + r.Account.Host + "/" + path.Join(r.Dir, r.Name)
+}
+
+func dialFTPAccount(acc ftpAccount) (*ftp.ServerConn, error) {
+	c, err := ftp.Dial(acc.Host+":21", ftp.DialWithTimeout(30*time.Second))
+	if err != nil {
+		return nil, fmt.Errorf("FTP dial %s: %v", acc.Host, err)
+	}
+	if err := c.Login(acc.User, acc.Pass); err != nil {
+		c.Quit()
+		return nil, fmt.Errorf("FTP login %s: %v", acc.Host, err)
+	}
+	return c, nil
+}
+
+// remoteRootOf is the directory of a host's backups on the FTP servers.
+func remoteRootOf(host string) string {
+	return path.Join(host, backupSubdir)
+}
+
+// remoteHosts lists the hosts that have backups on any account.
+func remoteHosts() []string {
+	seen := make(map[string]bool)
+	var hosts []string
+	for _, acc := range ftpAccounts {
+		c, err := dialFTPAccount(acc)
+		if err != nil {
+			log.Printf("%s%v%s", red, err, reset)
+			continue
+		}
+		entries, _ := c.List("")
+		for _, e := range entries {
+			if e.Type != ftp.EntryTypeFolder || seen[e.Name] || e.Name == "." || e.Name == ".." {
+				continue
+			}
+			if sub, err := c.List(remoteRootOf(e.Name)); err == nil && len(sub) > 0 {
+				seen[e.Name] = true
+				hosts = append(hosts, e.Name)
+			}
+		}
+		c.Quit()
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// remotePorts lists the instances of the source host on any account.
+func remotePorts() []string {
+	seen := make(map[string]bool)
+	var ports []string
+	for _, acc := range ftpAccounts {
+		c, err := dialFTPAccount(acc)
+		if err != nil {
+			log.Printf("%s%v%s", red, err, reset)
+			continue
+		}
+		entries, _ := c.List(remoteRootOf(sourceHostName()))
+		c.Quit()
+		for _, e := range entries {
+			if e.Type == ftp.EntryTypeFolder && strings.HasPrefix(e.Name, "redis_") {
+				p := strings.TrimPrefix(e.Name, "redis_")
+				if !seen[p] {
+					seen[p] = true
+					ports = append(ports, p)
+				}
+			}
+		}
+	}
+	sort.Strings(ports)
+	return ports
+}
+
+// listRemoteArchives lists the archives of an instance on every account,
+// oldest first; copies on several accounts keep the account order.
+func listRemoteArchives(port string, tiers []string) []remoteArchive {
+	if len(tiers) == 0 {
+		tiers = backupTiers
+	}
+	var out []remoteArchive
+	for _, acc := range ftpAccounts {
+		c, err := dialFTPAccount(acc)
+		if err != nil {
+			log.Printf("%s%v%s", red, err, reset)
+			continue
+		}
+		for _, tier := range tiers {
+			dir := path.Join(remoteRootOf(sourceHostName()), "redis_"+port, tier)
+			entries, err := c.List(dir)
+			if err != nil {
+				continue
+			}
+			for _, e := range entries {
+				if e.Type != ftp.EntryTypeFile || strings.HasSuffix(e.Name, partialSuffix) {
+					continue
+				}
+				r := remoteArchive{Account: acc, Dir: dir, Tier: tier, Time: e.Time}
+				if strings.HasSuffix(e.Name, unchangedSuffix) {
+					r.Name, r.Marker = e.Name, true
+				} else if name, ok := archiveLogicalName(e.Name); ok {
+					r.Name, r.Size = name, ftpArchiveSize(name, entries)
+				} else {
+					continue
+				}
+				if t, ok := nameStamp(r.Name); ok {
+					r.Time = t
+				}
+				out = append(out, r)
+			}
+		}
+		c.Quit()
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Time.Before(out[j].Time) })
+	return out
+}
+
+// readRemoteSnapshotTime reads the snapshot time from an archive's .meta (or
+// from the marker itself) on FTP.
+func readRemoteSnapshotTime(c *ftp.ServerConn, r remoteArchive) (time.Time, bool) {
+	name := r.Name + ".meta"
+	if r.Marker {
+		name = r.Name
+	}
+	data, err := ftpReadAll(c, path.Join(r.Dir, name))
+	if err != nil {
+		return time.Time{}, false
+	}
+	var v struct {
+		SnapshotTime int64 `json:"snapshot_time"`
+	}
+	if json.Unmarshal(data, &v) != nil || v.SnapshotTime <= 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(v.SnapshotTime, 0), true
+}
+
+// remoteSnapshots reads the snapshot times of FTP archives on demand,
+// keeping one connection per account.
+type remoteSnapshots struct {
+	conns map[ftpAccount]*ftp.ServerConn // nil: the account cannot be reached
+}
+
+func newRemoteSnapshots() *remoteSnapshots {
+	return &remoteSnapshots{conns: make(map[ftpAccount]*ftp.ServerConn)}
+}
+
+// time returns the snapshot time of r from its .meta, or the time of its
+// name when that cannot be read.
+func (s *remoteSnapshots) time(r remoteArchive) time.Time {
+	c, ok := s.conns[r.Account]
+	if !ok {
+		var err error
+		if c, err = dialFTPAccount(r.Account); err != nil {
+			log.Printf("%s%v%s", red, err, reset)
+		}
+		s.conns[r.Account] = c
+	}
+	if c == nil {
+		return r.Time
+	}
+	if t, ok := readRemoteSnapshotTime(c, r); ok {
+		return t
+	}
+	return r.Time
+}
+
+func (s *remoteSnapshots) close() {
+	for _, c := range s.conns {
+		if c != nil {
+			c.Quit()
+		}
+	}
+}
+
+// sameRemoteArchive returns all copies of r's archive, r first.
+func sameRemoteArchive(all []remoteArchive, r remoteArchive) []remoteArchive {
+	out := []remoteArchive{r}
+	for _, o := range all {
+		if o.Name == r.Name && (o.Account != r.Account || o.Dir != r.Dir) {
+			out = append(out, o)
+		}
+	}
+	return out
+}
+
+// fetchRemoteArchive downloads the first copy that passes its checksums into
+// a new temp directory. The caller removes tmpDir.
+func fetchRemoteArchive(copies []remoteArchive) (local, tmpDir string, src remoteArchive, err error) {
+	for _, r := range copies {
+		tmpDir, err = os.MkdirTemp("", "redis-backup-ftp-")
+		if err != nil {
+			return "", "", r, err
+		}
+		local, err = downloadRemoteArchive(r, tmpDir)
+		if err == nil {
+			err = verifyDownload(local)
+		}
+		if err == nil {
+			return local, tmpDir, r, nil
+		}
+		log.Printf("%s%s: %v%s", red, r, err, reset)
+		os.RemoveAll(tmpDir)
+	}
+	return "", "", remoteArchive{}, fmt.Errorf("no intact copy of %s on FTP", copies[0].Name)
+}
+
+// downloadRemoteArchive fetches an archive with its volumes and sidecars
+// into dir/<tier>/ and returns the local archive path.
+func downloadRemoteArchive(r remoteArchive, dir string) (string, error) {
+	c, err := dialFTPAccount(r.Account)
+	if err != nil {
+		return "", err
+	}
+	defer c.Quit()
+
+	name := r.Name
+	if r.Marker {
+		var m unchangedMarker
+		data, err := ftpReadAll(c, path.Join(r.Dir, r.Name))
+		if err == nil {
+			err = json.Unmarshal(data, &m)
+		}
+		if err != nil {
+			return "", fmt.Errorf("reading marker: %v", err)
+		}
+		name = m.SameAs
+		log.Printf("%sSnapshot was unchanged, using %s%s", cyan, name, reset)
+	}
+
+	entries, err := c.List(r.Dir)
+	if err != nil {
+		return "", err
+	}
+	if err := ftpCheckVolumes(c, r.Dir, name, entries); err != nil {
+		return "", err
+	}
+	var files []string
+	found := false
+	for _, e := range entries {
+		if e.Type != ftp.EntryTypeFile {
+			continue
+		}
+		switch {
+		case e.Name == name || e.Name == name+volumeIndexSuffix:
+			found = true
+		case e.Name == name+signatureSuffix || e.Name == name+".meta":
+		case isVolumeName(e.Name) && strings.HasPrefix(e.Name, name+"."):
+		default:
+			continue
+		}
+		files = append(files, e.Name)
+	}
+	if !found {
+		return "", fmt.Errorf("%s not found in %s", name, r.Dir)
+	}
+
+	local := filepath.Join(dir, r.Tier)
+	if err := os.MkdirAll(local, 0700); err != nil {
+		return "", err
+	}
+	log.Printf("%s⇩ Downloading %s from %s (%.1f MB)%s", cyan, name, r.Account.Host, humanMB(r.Size), reset)
+	for _, f := range files {
+		if err := ftpDownload(c, path.Join(r.Dir, f), filepath.Join(local, f)); err != nil {
+			return "", fmt.Errorf("downloading %s: %v", f, err)
+		}
+	}
+	return filepath.Join(local, name), nil
+}
+
+func ftpReadAll(c *ftp.ServerConn, remote string) ([]byte, error) {
+	resp, err := c.Retr(remote)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Close()
+	return io.ReadAll(resp)
+}
+
+func ftpDownload(c *ftp.ServerConn, remote, local string) error {
+	resp, err := c.Retr(remote)
+	if err != nil {
+		return err
+	}
+	defer resp.Close()
+	f, err := os.Create(local + partialSuffix)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, resp); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(local+partialSuffix, local)
+}
+
+// verifyDownload checks a downloaded archive against whatever checksums
+// travelled with it: the signed manifest, the volume index and the RDB
+// checksum in .meta. Reading the RDB also checks the gzip CRC.
+func verifyDownload(archive string) error {
+	checked := false
+	if m, err := readSignedManifest(archive); err == nil {
+		if err := checkManifestFiles(filepath.Dir(archive), m); err != nil {
+			return err
+		}
+		if err := checkSignedSidecars(archive, m); err != nil {
+			return err
+		}
+		checked = true
+	} else if !errors.Is(err, errNoSignature) {
+		return err
+	}
+
+	if err := checkVolumes(archive); err != nil {
+		return err
+	}
+	if isSplitArchive(archive) {
+		idx, err := readVolumeIndex(archive + volumeIndexSuffix)
+		if err != nil {
+			return err
+		}
+		for _, p := range idx.Parts {
+			sum, err := fileSHA256(filepath.Join(filepath.Dir(archive), p.Name))
+			if err != nil {
+				return err
+			}
+			if p.SHA256 != "" && sum != p.SHA256 {
+				return fmt.Errorf("volume %s: checksum mismatch", p.Name)
+			}
+		}
+		checked = true
+	}
+
+	sum, err := archivedRDBSHA256(archive)
+	if err != nil {
+		return fmt.Errorf("archive is damaged: %v", err)
+	}
+	if want, source := expectedRDBSHA256(archive); want != "" {
+		if sum != want {
+			return fmt.Errorf("RDB checksum does not match %s", source)
+		}
+		checked = true
+	}
+
+	if checked {
+		log.Printf("%s✔ Checksums OK%s", green, reset)
+	} else {
+		log.Printf("%s⚠  No checksums on FTP for %s, only the gzip CRC was checked%s", yellow, filepath.Base(archive), reset)
+	}
+	return nil
+}
+
+// archivedRDBSHA256 hashes the RDB inside an archive.
+func archivedRDBSHA256(path string) (string, error) {
+	a, err := openArchivedRDB(path)
+	if err != nil {
+		return "", err
+	}
+	defer a.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, a); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// listRemoteBackups prints the archives on every FTP account (--list --from-ftp).
+func listRemoteBackups() {
+	if !ftpEnabled {
+		log.Fatalf("%sNo FTP accounts configured (%s or --ftp-host)%s", red, ftpConfFile, reset)
+	}
+	if sourceHost != "" {
+		fmt.Printf("%s🖥  Backups of host %s%s\n", cyan, sourceHost, reset)
+	}
+	for _, port := range remotePorts() {
+		fmt.Printf("%s📂 redis_%s%s\n", cyan, port, reset)
+		for _, r := range listRemoteArchives(port, nil) {
+			if r.Marker {
+				fmt.Printf("  • %-9s %s (unchanged) @ %s\n", r.Tier, r.Name, r.Account.Host)
+				continue
+			}
+			fmt.Printf("  • %-9s %s — %.1f MB @ %s\n", r.Tier, r.Name, humanMB(r.Size), r.Account.Host)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestVerifyDownload(t *testing.T) {
+	archive := signedTestArchive(t)
+	if err := verifyDownload(archive); err != nil {
+		t.Fatalf("intact download: %v", err)
+	}
+
+	// a rewritten .meta is caught against the signed manifest
+	meta, err := readBackupMeta(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta.RDBSHA256 = strings.Repeat("0", 64)
+	data, _ := json.Marshal(meta)
+	if err := os.WriteFile(archive+".meta", data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyDownload(archive); err == nil {
+		t.Fatal("download with a rewritten .meta passed")
+	}
+}
@@ -0,0 +1,410 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/****************** RESTORE JOURNAL ******************/
+// Every restore moves the RDB it replaces aside as <rdb>.pre-restore-<time>
+// (saved first when Redis was running) and appends a line to the journal
+// in the host's backup directory. rollback puts such a snapshot back, so
+// any earlier state can be returned to, not just the last one.
+
+const snapshotInfix = ".pre-restore-"
+
+// journalEntry is one line of the restore journal.
+type journalEntry struct {
+	ID              int    `json:"id"`
+	Time            string `json:"time"`
+	Action          string `json:"action"` // restore or rollback
+	Port            string `json:"port"`
+	Archive         string `json:"archive"`
+	RDBFile         string `json:"rdb_file"`
+	Snapshot        string `json:"snapshot,omitempty"`         // the replaced RDB
+	SnapshotArchive string `json:"snapshot_archive,omitempty"` // its copy in the backup tree
+	Keys            int64  `json:"keys,omitempty"`
+	RollbackOf      int    `json:"rollback_of,omitempty"`
+	OK              bool   `json:"ok"`
+	Error           string `json:"error,omitempty"`
+}
+
+func journalPath() string {
+	return filepath.Join(hostBackupRoot(), "restore-journal.jsonl")
+}
+
+// snapshotName is where the RDB replaced at t is kept.
+func snapshotName(rdbFile string, t time.Time) string {
+	return rdbFile + snapshotInfix + t.Format("2006-01-02_15-04-05")
+}
+
+// keepSnapshot moves rdbFile to the snapshot name without overwriting an
+// older snapshot: a second restore within the same second gets a "-2", "-3"…
+// suffix. It returns the name used.
+func keepSnapshot(rdbFile, name string) (string, error) {
+	for i := 1; ; i++ {
+		dst := name
+		if i > 1 {
+			dst = fmt.Sprintf("%s-%d", name, i)
+		}
+		err := os.Link(rdbFile, dst)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			// no hardlinks here: fall back to a rename onto a free name
+			if _, serr := os.Lstat(dst); serr == nil {
+				continue
+			}
+			return dst, os.Rename(rdbFile, dst)
+		}
+		return dst, os.Remove(rdbFile)
+	}
+}
+
+// readJournal returns the journal entries, oldest first.
+func readJournal() ([]journalEntry, error) {
+	f, err := os.Open(journalPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var out []journalEntry
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		var e journalEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err == nil {
+			out = append(out, e)
+		}
+	}
+	return out, sc.Err()
+}
+
+// appendJournal numbers e and adds it to the journal.
+func appendJournal(e *journalEntry) error {
+	entries, err := readJournal()
+	if err != nil {
+		return err
+	}
+	e.ID = 1
+	if n := len(entries); n > 0 {
+		e.ID = entries[n-1].ID + 1
+	}
+	e.Time = time.Now().Format(time.RFC3339)
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(hostBackupRoot(), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(journalPath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// record writes the journal entry of an executed plan.
+func (p *restorePlan) record(res *restoreResult, failure error) {
+	e := &journalEntry{Action: "restore", Port: p.TargetPort, Archive: p.Archive, RDBFile: p.RDBFile, RollbackOf: p.rollbackOf}
+	if p.rollbackOf > 0 {
+		e.Action = "rollback"
+	}
+	if failure != nil {
+		e.Error = failure.Error()
+	} else {
+		e.OK = true
+		e.Snapshot, e.SnapshotArchive, e.Keys = res.PreviousFile, res.SnapshotArchive, res.Keys
+	}
+	if err := appendJournal(e); err != nil {
+		suggestSudo(err)
+		log.Printf("%s⚠  Cannot write the restore journal %s: %v%s", yellow, journalPath(), err, reset)
+		return
+	}
+	if res != nil {
+		res.JournalID = e.ID
+	}
+}
+
+/*************** SNAPSHOTS ***************/
+
+// rdbSnapshots lists the pre-restore snapshots of rdbFile, oldest first.
+func rdbSnapshots(rdbFile string) []string {
+	matches, _ := filepath.Glob(rdbFile + snapshotInfix + "*")
+	var out []string
+	for _, m := range matches {
+		if _, ok := nameStamp(strings.TrimPrefix(m, rdbFile+snapshotInfix)); ok {
+			out = append(out, m)
+		}
+	}
+	sort.Strings(out) // the stamp sorts by time
+	return out
+}
+
+// pruneSnapshots keeps the --keep-snapshots newest snapshots of rdbFile
+// and of the archived ones in dir.
+func pruneSnapshots(rdbFile, dir string) {
+	if keepSnapshots <= 0 {
+		return
+	}
+	snaps := rdbSnapshots(rdbFile)
+	for len(snaps) > keepSnapshots {
+		log.Printf("%s🗑  Removing old pre-restore snapshot %s%s", yellow, filepath.Base(snaps[0]), reset)
+		_ = os.Remove(snaps[0])
+		snaps = snaps[1:]
+	}
+	var archives []string
+	for _, e := range localRetentionEntries(dir) {
+		if !e.Marker {
+			archives = append(archives, filepath.Join(dir, e.Name))
+		}
+	}
+	// by stamp, so a "-2" snapshot of the same second sorts after the first
+	stamp := func(path string) string { return archiveNameRe.ReplaceAllString(filepath.Base(path), "") }
+	sort.Slice(archives, func(i, j int) bool { return stamp(archives[i]) < stamp(archives[j]) })
+	for len(archives) > keepSnapshots {
+		removeArchive(archives[0])
+		archives = archives[1:]
+	}
+}
+
+// snapshotDir is the backup tier that takes archived pre-restore snapshots.
+func snapshotDir(port string) string {
+	return filepath.Join(hostBackupRoot(), "redis_"+port, "pre-restore")
+}
+
+// archiveSnapshot stores a pre-restore snapshot like a normal backup
+// (--archive-snapshot) and returns the archive path.
+func archiveSnapshot(snapshot, port string) (string, error) {
+	dir := snapshotDir(port)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	ts := snapshot[strings.LastIndex(snapshot, snapshotInfix)+len(snapshotInfix):]
+	archive := filepath.Join(dir, fmt.Sprintf("%s_redis_%s.tar.gz", ts, port))
+	checksum, _ := fileSHA256(snapshot)
+	if err := createTarGz(archive, []string{snapshot}); err != nil {
+		return "", err
+	}
+	if err := writeBackupMeta(archive, snapshot, checksum); err != nil {
+		log.Printf("%sFailed to store backup metadata for %s: %v%s", yellow, archive, err, reset)
+	}
+	if _, err := storeKeyspaceSummary(archive); err != nil {
+		log.Printf("%sCannot summarize archived RDB %s: %v%s", yellow, filepath.Base(archive), err, reset)
+	}
+	host, _ := os.Hostname()
+	if err := signArchive(archive, host, port); err != nil {
+		log.Printf("%sCannot sign %s: %v%s", red, archive, err, reset)
+	}
+	return archive, nil
+}
+
+// copyRDB copies src to dst like extractRDB: through a new synced temp file.
+func copyRDB(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := dst + partialSuffix
+	_ = os.Remove(tmp)
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp) // no-op once renamed
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(dst))
+}
+
+/*************** ROLLBACK ***************/
+
+// planRollback plans putting back the RDB that a journal entry replaced:
+// the snapshot file while it exists, otherwise its archived copy.
+func planRollback(e journalEntry) (*restorePlan, error) {
+	if !e.OK || e.Snapshot == "" {
+		return nil, restoreFailf(exitRestoreUsage, "journal entry %d replaced no RDB, there is nothing to roll back to", e.ID)
+	}
+	if _, err := os.Stat(e.Snapshot); err != nil {
+		if e.SnapshotArchive == "" {
+			return nil, restoreFailf(exitRestoreUsage, "snapshot %s is gone and was not archived", e.Snapshot)
+		}
+		log.Printf("%sSnapshot %s is gone, using %s%s", yellow, filepath.Base(e.Snapshot), e.SnapshotArchive, reset)
+		p, err := planRestore(e.SnapshotArchive, e.Port)
+		if p != nil {
+			p.rollbackOf = e.ID
+		}
+		return p, err
+	}
+
+	p := &restorePlan{SourcePort: e.Port, TargetPort: e.Port, Archive: e.Snapshot, Tier: "pre-restore",
+		UID: -1, GID: -1, mode: 0644, archivePath: e.Snapshot, rawRDB: true, rollbackOf: e.ID}
+	if info, err := os.Stat(e.Snapshot); err == nil {
+		p.SnapshotTime = info.ModTime().Format(time.RFC3339)
+		p.Restored = &datasetStats{Bytes: info.Size(), From: "snapshot"}
+	}
+	if f, err := os.Open(e.Snapshot); err == nil {
+		s, err := summarizeRDB(f)
+		f.Close()
+		if err == nil {
+			p.expected, p.RDBVersion = s, s.RDBVersion
+			p.Restored.Keys, p.Restored.DBs = s.Keys, make(map[string]int64)
+			for db, n := range s.DBs {
+				p.Restored.DBs[db] = n.Keys
+			}
+		} else {
+			p.warn("no key counts to verify against: " + err.Error())
+		}
+	}
+	if v, err := targetRedisVersion(e.Port); err == nil {
+		p.TargetRedis, p.MaxRDB = v, maxRDBVersion(v)
+		if p.RDBVersion > p.MaxRDB {
+			err := fmt.Errorf("snapshot is RDB v%d, Redis %s reads up to v%d", p.RDBVersion, v, p.MaxRDB)
+			if !forceVersion {
+				return p, restoreFailf(exitRestoreRefused, "refusing to roll back: %v (--force-version to override)", err)
+			}
+			p.warn(err.Error() + " — rolling back anyway (--force-version)")
+		}
+	}
+	return p, p.planTarget()
+}
+
+// printJournal lists the journal for people.
+func printJournal(entries []journalEntry) {
+	if len(entries) == 0 {
+		fmt.Println("The restore journal is empty")
+		return
+	}
+	for _, e := range entries {
+		status := green + "✔" + reset
+		if !e.OK {
+			status = red + "✘" + reset
+		}
+		what := filepath.Base(e.Archive)
+		if e.RollbackOf > 0 {
+			what = fmt.Sprintf("rollback of #%d", e.RollbackOf)
+		}
+		fmt.Printf("  #%-4d %s %s  redis_%-6s %-8s %s\n", e.ID, status, e.Time, e.Port, e.Action, what)
+		if e.Snapshot != "" {
+			fmt.Printf("         previous RDB → %s\n", filepath.Base(e.Snapshot))
+		}
+		if e.Error != "" {
+			fmt.Printf("         %s%s%s\n", red, e.Error, reset)
+		}
+	}
+}
+
+func cmdRollback(args []string) int {
+	if len(args) > 1 || (len(args) == 1 && targetPort != "") {
+		fmt.Fprintf(os.Stderr, "%susage: rollback (<journal id> | --port P) --yes%s\n", red, reset)
+		return exitRestoreUsage
+	}
+	entries, err := readJournal()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%scannot read %s: %v%s\n", red, journalPath(), err, reset)
+		return exitRestoreUsage
+	}
+	if len(args) == 0 && targetPort == "" {
+		if outputFormat == "json" {
+			printJSON(entries)
+		} else {
+			printJournal(entries)
+		}
+		return 0
+	}
+
+	var entry *journalEntry
+	for i := len(entries) - 1; i >= 0 && entry == nil; i-- {
+		e := entries[i]
+		switch {
+		case len(args) == 1 && strconv.Itoa(e.ID) == strings.TrimPrefix(args[0], "#"):
+			entry = &entries[i]
+		case len(args) == 0 && e.Port == targetPort && e.OK && e.Snapshot != "":
+			entry = &entries[i]
+		}
+	}
+	if entry == nil {
+		if len(args) == 1 {
+			fmt.Fprintf(os.Stderr, "%sno journal entry %s%s\n", red, args[0], reset)
+		} else {
+			fmt.Fprintf(os.Stderr, "%sno restore of Redis %s in the journal%s\n", red, targetPort, reset)
+		}
+		return exitRestoreUsage
+	}
+
+	if !assumeYes && !dryRun {
+		fmt.Fprintf(os.Stderr, "%sRedis %s would be rolled back to the state before #%d (%s); add --yes to do it (or --dry-run for the plan)%s\n",
+			yellow, entry.Port, entry.ID, entry.Time, reset)
+		return exitRestoreUsage
+	}
+
+	plan, err := planRollback(*entry)
+	if dryRun {
+		if plan != nil {
+			if outputFormat == "json" {
+				printJSON(plan)
+			} else {
+				printPlan(plan)
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s%v%s\n", red, err, reset)
+			return restoreExitCode(err)
+		}
+		return 0
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s%v%s\n", red, err, reset)
+		return restoreExitCode(err)
+	}
+
+	res, err := plan.execute()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s%v%s\n", red, err, reset)
+		return restoreExitCode(err)
+	}
+	if outputFormat == "json" {
+		printJSON(res)
+		return 0
+	}
+	fmt.Printf("%s✔ Redis %s is back at the state before #%d%s\n", green, res.TargetPort, entry.ID, reset)
+	return 0
+}
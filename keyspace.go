@@ -0,0 +1,144 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/****************** KEYSPACE SUMMARY ******************/
+// After an archive is written its RDB is parsed once more and a compact
+// description of the dataset is kept in the .meta sidecar. --list and the
+// restore wizard show it, which makes a backup taken right after an
+// accidental FLUSHALL easy to spot.
+
+type keyspaceSummary struct {
+	RDBVersion     int                  `json:"rdb_version"`
+	RedisVersion   string               `json:"redis_version,omitempty"`
+	Keys           int64                `json:"keys"`
+	Expires        int64                `json:"expires"`
+	SerializedSize int64                `json:"serialized_size"`
+	DBs            map[string]dbSummary `json:"dbs"`
+	Types          map[string]int64     `json:"types"`
+	Modules        []string             `json:"modules,omitempty"`
+}
+
+type dbSummary struct {
+	Keys    int64 `json:"keys"`
+	Expires int64 `json:"expires"`
+}
+
+func newKeyspaceSummary() *keyspaceSummary {
+	return &keyspaceSummary{DBs: make(map[string]dbSummary), Types: make(map[string]int64)}
+}
+
+func (s *keyspaceSummary) add(e *rdbEntry) {
+	s.Keys++
+	s.SerializedSize += int64(len(e.Key)) + e.Size
+	s.Types[rdbTypeName(e.Type)]++
+
+	db := s.DBs[strconv.Itoa(e.DB)]
+	db.Keys++
+	if e.ExpireMs > 0 {
+		db.Expires++
+		s.Expires++
+	}
+	s.DBs[strconv.Itoa(e.DB)] = db
+}
+
+// summarizeArchive parses the dump inside an archive and counts its keys.
+func summarizeArchive(path string) (*keyspaceSummary, error) {
+	a, err := openArchivedRDB(path)
+	if err != nil {
+		return nil, err
+	}
+	defer a.Close()
+	return summarizeRDB(a)
+}
+
+// summarizeRDB counts the keys of a dump stream.
+func summarizeRDB(r io.Reader) (*keyspaceSummary, error) {
+	s := newKeyspaceSummary()
+	info, err := parseRDB(r, captureNone, func(e *rdbEntry) error {
+		s.add(e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.RDBVersion = info.Version
+	s.RedisVersion = info.Aux["redis-ver"]
+	s.Modules = info.Modules
+	return s, nil
+}
+
+// storeKeyspaceSummary adds the summary to the archive's metadata.
+func storeKeyspaceSummary(path string) (*keyspaceSummary, error) {
+	s, err := summarizeArchive(path)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := readBackupMeta(path)
+	if err != nil {
+		return s, err
+	}
+	meta.Keyspace = s
+	return s, saveBackupMeta(path, meta)
+}
+
+// sortedDBs returns the database numbers of a summary in numeric order.
+func (s *keyspaceSummary) sortedDBs() []string {
+	var dbs []string
+	for db := range s.DBs {
+		dbs = append(dbs, db)
+	}
+	sort.Slice(dbs, func(i, j int) bool {
+		a, _ := strconv.Atoi(dbs[i])
+		b, _ := strconv.Atoi(dbs[j])
+		return a < b
+	})
+	return dbs
+}
+
+// String renders the summary on one line: keys per db, types, TTLs and size.
+func (s *keyspaceSummary) String() string {
+	if s.Keys == 0 {
+		return "EMPTY dataset"
+	}
+	var dbs []string
+	for _, db := range s.sortedDBs() {
+		dbs = append(dbs, fmt.Sprintf("db%s=%d", db, s.DBs[db].Keys))
+	}
+	var types []string
+	for t, n := range s.Types {
+		types = append(types, fmt.Sprintf("%s %d", t, n))
+	}
+	sort.Strings(types)
+	return fmt.Sprintf("%d keys (%s; %s; %d with TTL; %.1f MB)",
+		s.Keys, strings.Join(dbs, " "), strings.Join(types, ", "),
+		s.Expires, humanMB(s.SerializedSize))
+}
+
+// describeArchive is the annotation shown next to an archive name. prev is
+// the summary of the archive before it, used to flag a sudden key loss.
+func describeArchive(path string, prev *keyspaceSummary) (string, *keyspaceSummary) {
+	meta, err := readBackupMeta(path)
+	if err != nil || meta.Keyspace == nil {
+		return "", prev
+	}
+	s := meta.Keyspace
+	text := s.String()
+	switch {
+	case s.Keys == 0:
+		text = red + text + reset
+	case prev != nil && prev.Keys > 0 && s.Keys*2 < prev.Keys:
+		text = fmt.Sprintf("%s%s  ⚠ %d%% fewer keys than the previous backup%s",
+			yellow, text, 100-s.Keys*100/prev.Keys, reset)
+	}
+	return text, s
+}
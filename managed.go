@@ -0,0 +1,315 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/shirou/gopsutil/v3/net"
+	"github.com/shirou/gopsutil/v3/process"
+)
+
+/****************** MANAGED RESTORE ******************/
+// A running Redis keeps its dataset in memory and writes it back on the next
+// BGSAVE or on shutdown, so a restored RDB must not be put under its feet.
+// The target is stopped, the file swapped, the target started again and the
+// loaded key counts compared with the archive; on failure the previous RDB
+// is put back.
+
+// redisLauncher knows how to start an instance again after it was stopped.
+type redisLauncher struct {
+	port string
+	argv []string // empty when --start-cmd is used
+	dir  string
+	uid  uint32
+	gid  uint32
+	aof  bool // appendonly is on: Redis would load the AOF, not the RDB
+
+	rdbDir, rdbFile string // dir and dbfilename before the stop
+}
+
+// redisRunning tells whether an instance answers on its port.
+func redisRunning(port string) bool {
+	c, err := dialRedis(port)
+	if err != nil {
+		return false
+	}
+	defer c.Close()
+	_, err = c.do("PING")
+	return err == nil
+}
+
+// redisProcess returns the redis-server process listening on port.
+func redisProcess(port string) (*process.Process, error) {
+	conns, err := net.Connections("tcp")
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range conns {
+		if c.Status != "LISTEN" || c.Pid == 0 || strconv.Itoa(int(c.Laddr.Port)) != port {
+			continue
+		}
+		proc, err := process.NewProcess(c.Pid)
+		if err != nil {
+			continue
+		}
+		if name, _ := proc.Name(); strings.Contains(strings.ToLower(name), "redis-server") {
+			return proc, nil
+		}
+	}
+	return nil, fmt.Errorf("no redis-server process listens on port %s", port)
+}
+
+// processOwner returns the effective uid and gid of proc. gopsutil lists
+// real, effective, … ids on Linux but only the effective one on darwin.
+func processOwner(proc *process.Process) (uid, gid uint32, err error) {
+	uids, err := proc.Uids()
+	if err != nil {
+		return 0, 0, err
+	}
+	gids, err := proc.Gids()
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(uids) == 0 || len(gids) == 0 {
+		return 0, 0, fmt.Errorf("no ids for pid %d", proc.Pid)
+	}
+	effective := func(ids []int32) uint32 {
+		if len(ids) > 1 {
+			return uint32(ids[1])
+		}
+		return uint32(ids[0])
+	}
+	return effective(uids), effective(gids), nil
+}
+
+// redisSupervisor names the service manager that restarts the instance on
+// port by itself ("" if none is found): Redis' own supervised setting or, on
+// Linux, a systemd service cgroup of the process.
+func redisSupervisor(port string) string {
+	switch mode := getRedisConfig(port, "supervised"); mode {
+	case "systemd", "upstart":
+		return mode
+	}
+	proc, err := redisProcess(port)
+	if err != nil {
+		return ""
+	}
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/cgroup", proc.Pid))
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		unit := line[strings.LastIndexByte(line, '/')+1:]
+		if strings.HasSuffix(unit, ".service") {
+			return "systemd unit " + unit
+		}
+	}
+	return ""
+}
+
+// prepareLauncher records how the running instance on port can be started
+// again. redis-server rewrites its process title, so the command line is
+// rebuilt from INFO server (executable, config_file) instead; port, dir and
+// dbfilename are passed explicitly as they may have been overridden.
+func prepareLauncher(port string) (*redisLauncher, error) {
+	l := &redisLauncher{port: port, aof: getRedisConfig(port, "appendonly") == "yes",
+		rdbDir: getRedisDir(port), rdbFile: getRedisRDB(port)}
+	if stopCmd == "" || startCmd == "" {
+		// a service manager would start Redis again on the old RDB mid-swap
+		if sup := redisSupervisor(port); sup != "" {
+			return nil, fmt.Errorf("Redis %s is supervised (%s); restore with --stop-cmd and --start-cmd "+
+				"that go through it, e.g. 'systemctl stop/start <unit>'", port, sup)
+		}
+	}
+	if startCmd != "" {
+		if l.aof {
+			return nil, fmt.Errorf("appendonly is on, so Redis %s would load its AOF instead of the restored RDB; "+
+				"restore without --start-cmd or switch AOF off first", port)
+		}
+		return l, nil
+	}
+
+	c, err := dialRedis(port)
+	if err != nil {
+		return nil, err
+	}
+	info, err := redisInfo(c, "server")
+	c.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	proc, err := redisProcess(port)
+	if err != nil {
+		return nil, err
+	}
+	exe := info["executable"]
+	if exe == "" {
+		if exe, err = proc.Exe(); err != nil {
+			return nil, fmt.Errorf("cannot find the redis-server binary of port %s: %v", port, err)
+		}
+	}
+	l.dir, _ = proc.Cwd()
+	if uid, gid, err := processOwner(proc); err == nil {
+		l.uid, l.gid = uid, gid
+	}
+
+	l.argv = []string{exe}
+	if conf := info["config_file"]; conf != "" {
+		l.argv = append(l.argv, conf)
+	}
+	l.argv = append(l.argv, "--port", port, "--dir", l.rdbDir, "--dbfilename", l.rdbFile)
+	return l, nil
+}
+
+// runServiceCmd runs a --stop-cmd / --start-cmd template for port.
+func runServiceCmd(tmpl, port string) error {
+	line := strings.ReplaceAll(tmpl, "{port}", port)
+	out, err := exec.Command("sh", "-c", line).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %v %s", line, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// describeStop tells how instances are stopped, for prompts.
+func describeStop() string {
+	if stopCmd != "" {
+		return stopCmd
+	}
+	return "SHUTDOWN NOSAVE"
+}
+
+// saveRedis writes the dataset of a running instance to its RDB.
+func saveRedis(port string) error {
+	c, err := dialRedis(port)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	_, err = c.do("SAVE")
+	return err
+}
+
+// stopRedis stops the instance without letting it save its dataset.
+func stopRedis(port string) error {
+	if stopCmd != "" {
+		if err := runServiceCmd(stopCmd, port); err != nil {
+			return err
+		}
+	} else if c, err := dialRedis(port); err == nil {
+		_, _ = c.do("SHUTDOWN", "NOSAVE") // the connection just closes on success
+		c.Close()
+	}
+
+	deadline := time.Now().Add(60 * time.Second)
+	for redisRunning(port) {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Redis %s is still running", port)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	return nil
+}
+
+// start launches the instance again. With AOF on and aofOff set it starts
+// with appendonly off, so the RDB is what gets loaded.
+func (l *redisLauncher) start(aofOff bool) error {
+	if startCmd != "" {
+		return runServiceCmd(startCmd, l.port)
+	}
+	args := append([]string{}, l.argv[1:]...)
+	if l.aof && aofOff {
+		args = append(args, "--appendonly", "no")
+	}
+	cmd := exec.Command(l.argv[0], args...)
+	cmd.Dir = l.dir
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if os.Geteuid() == 0 && l.uid != 0 {
+		cmd.SysProcAttr.Credential = &syscall.Credential{Uid: l.uid, Gid: l.gid}
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("starting %s: %w", l.argv[0], err)
+	}
+	return cmd.Process.Release()
+}
+
+// startAndVerify starts the instance and waits until it has loaded the
+// restored RDB with the key counts of the archive.
+func (l *redisLauncher) startAndVerify(expected *keyspaceSummary) (int64, error) {
+	log.Printf("%s▶  Starting Redis %s%s", cyan, l.port, reset)
+	if err := l.start(true); err != nil {
+		return 0, err
+	}
+	if err := waitForLoading(l.port, time.Duration(loadTimeoutSec)*time.Second); err != nil {
+		return 0, fmt.Errorf("Redis %s did not come up: %v", l.port, err)
+	}
+	// a relaunch that lost command-line overrides would read another file
+	if dir, file := getRedisDir(l.port), getRedisRDB(l.port); dir != l.rdbDir || file != l.rdbFile {
+		return 0, fmt.Errorf("Redis %s came back with dir %q and dbfilename %q instead of %q and %q",
+			l.port, dir, file, l.rdbDir, l.rdbFile)
+	}
+	c, err := dialRedis(l.port)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+	loaded, err := loadedKeyspace(c)
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	if expected != nil {
+		if total, err = compareKeyspace(expected, loaded); err != nil {
+			return total, err
+		}
+	} else {
+		for _, db := range loaded {
+			total += db.Keys
+		}
+	}
+
+	if l.aof && startCmd == "" {
+		// switching AOF on rewrites it from the restored dataset
+		if _, err := c.do("CONFIG", "SET", "appendonly", "yes"); err != nil {
+			log.Printf("%s⚠  Redis %s: cannot switch AOF back on: %v%s", yellow, l.port, err, reset)
+		} else {
+			log.Printf("%s🔁 Redis %s: AOF is being rewritten from the restored data%s", cyan, l.port, reset)
+		}
+	}
+	return total, nil
+}
+
+// rollback puts the previous RDB back and starts the instance with it. An
+// empty currentFile means the files were not touched yet.
+func (l *redisLauncher) rollback(currentFile, previousFile string) error {
+	log.Printf("%s↩  Rolling back Redis %s%s", yellow, l.port, reset)
+	if redisRunning(l.port) {
+		if err := stopRedis(l.port); err != nil {
+			return err
+		}
+	}
+	if currentFile != "" {
+		if err := os.Remove(currentFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if previousFile != "" {
+			if err := os.Rename(previousFile, currentFile); err != nil {
+				return err
+			}
+		}
+	}
+	if err := l.start(false); err != nil {
+		return err
+	}
+	return waitForLoading(l.port, time.Duration(loadTimeoutSec)*time.Second)
+}
@@ -0,0 +1,1430 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+)
+
+/********************** RDB READER **********************/
+// A streaming reader for Redis RDB files (versions 1–12). It walks every
+// opcode and value encoding, keeps a running CRC64 and hands each key to a
+// callback, so whole dumps can be checked or inspected without Redis.
+
+// RDB opcodes
+const (
+	rdbOpSlotInfo      = 0xF4
+	rdbOpFunction2     = 0xF5
+	rdbOpFunctionPreGA = 0xF6
+	rdbOpModuleAux     = 0xF7
+	rdbOpIdle          = 0xF8
+	rdbOpFreq          = 0xF9
+	rdbOpAux           = 0xFA
+	rdbOpResizeDB      = 0xFB
+	rdbOpExpireMs      = 0xFC
+	rdbOpExpire        = 0xFD
+	rdbOpSelectDB      = 0xFE
+	rdbOpEOF           = 0xFF
+)
+
+// RDB value types
+const (
+	rdbTypeString            = 0
+	rdbTypeList              = 1
+	rdbTypeSet               = 2
+	rdbTypeZset              = 3
+	rdbTypeHash              = 4
+	rdbTypeZset2             = 5
+	rdbTypeModule            = 6
+	rdbTypeModule2           = 7
+	rdbTypeHashZipmap        = 9
+	rdbTypeListZiplist       = 10
+	rdbTypeSetIntset         = 11
+	rdbTypeZsetZiplist       = 12
+	rdbTypeHashZiplist       = 13
+	rdbTypeListQuicklist     = 14
+	rdbTypeStreamListpacks   = 15
+	rdbTypeHashListpack      = 16
+	rdbTypeZsetListpack      = 17
+	rdbTypeListQuicklist2    = 18
+	rdbTypeStreamListpacks2  = 19
+	rdbTypeSetListpack       = 20
+	rdbTypeStreamListpacks3  = 21
+	rdbTypeHashMetadataPreGA = 22
+	rdbTypeHashListpackExPre = 23
+	rdbTypeHashMetadata      = 24
+	rdbTypeHashListpackEx    = 25
+)
+
+// rdbMaxVersion is the newest RDB format this reader understands.
+const rdbMaxVersion = 12
+
+// rdbTypeName maps an RDB value type to the Redis data type it stores.
+func rdbTypeName(t byte) string {
+	switch t {
+	case rdbTypeString:
+		return "string"
+	case rdbTypeList, rdbTypeListZiplist, rdbTypeListQuicklist, rdbTypeListQuicklist2:
+		return "list"
+	case rdbTypeSet, rdbTypeSetIntset, rdbTypeSetListpack:
+		return "set"
+	case rdbTypeZset, rdbTypeZset2, rdbTypeZsetZiplist, rdbTypeZsetListpack:
+		return "zset"
+	case rdbTypeHash, rdbTypeHashZipmap, rdbTypeHashZiplist, rdbTypeHashListpack,
+		rdbTypeHashMetadataPreGA, rdbTypeHashListpackExPre, rdbTypeHashMetadata, rdbTypeHashListpackEx:
+		return "hash"
+	case rdbTypeStreamListpacks, rdbTypeStreamListpacks2, rdbTypeStreamListpacks3:
+		return "stream"
+	case rdbTypeModule, rdbTypeModule2:
+		return "module"
+	}
+	return "unknown"
+}
+
+/*************** DECODED VALUES ***************/
+
+type zsetMember struct {
+	Member []byte
+	Score  float64
+}
+
+type hashField struct {
+	Field    []byte
+	Value    []byte
+	ExpireMs int64 // per-field TTL (Redis 7.4+), 0 = none
+}
+
+type streamEntry struct {
+	ID     string
+	Fields [][2][]byte
+}
+
+type rdbStream struct {
+	Entries []streamEntry
+	Length  uint64
+	LastID  string
+	Groups  int
+}
+
+type rdbModuleValue struct {
+	Module string
+}
+
+// rdbEntry is one key as found in the dump. Value holds []byte (string),
+// [][]byte (list, set), []zsetMember, []hashField, *rdbStream or rdbModuleValue.
+type rdbEntry struct {
+	DB       int
+	Key      []byte
+	Type     byte
+	ExpireMs int64 // absolute unix ms, 0 = no TTL
+	Value    interface{}
+	Size     int64  // serialized size of the value in the dump
+	Raw      []byte // serialized value, only when capturing (see dumpPayload)
+	Version  int    // RDB version of the dump the key comes from
+}
+
+// rdbInfo describes the dump as a whole.
+type rdbInfo struct {
+	Version  int
+	Aux      map[string]string
+	Modules  []string // module types and aux data found in the dump
+	Keys     int64
+	Checksum uint64 // stored CRC64, 0 when saved with rdbchecksum no
+	Size     int64  // bytes consumed up to and including the checksum
+}
+
+/*************** LOW LEVEL ***************/
+
+type rdbReader struct {
+	r       *bufio.Reader
+	crc     uint64
+	pos     int64
+	capture *bytes.Buffer
+}
+
+func newRDBReader(r io.Reader) *rdbReader {
+	return &rdbReader{r: bufio.NewReaderSize(r, 64*1024)}
+}
+
+func (p *rdbReader) consumed(b []byte) {
+	p.crc = crc64Update(p.crc, b)
+	p.pos += int64(len(b))
+	if p.capture != nil {
+		p.capture.Write(b)
+	}
+}
+
+func (p *rdbReader) readByte() (byte, error) {
+	b, err := p.r.ReadByte()
+	if err != nil {
+		return 0, unexpectedEOF(err)
+	}
+	p.consumed([]byte{b})
+	return b, nil
+}
+
+// maxRDBChunk bounds single allocations so a corrupt length cannot exhaust memory.
+const maxRDBChunk = 1 << 20
+
+func (p *rdbReader) readN(n uint64) ([]byte, error) {
+	if n > math.MaxInt32 {
+		return nil, fmt.Errorf("implausible length %d at offset %d", n, p.pos)
+	}
+	buf := make([]byte, 0, min64(n, maxRDBChunk))
+	for uint64(len(buf)) < n {
+		chunk := min64(n-uint64(len(buf)), maxRDBChunk)
+		start := len(buf)
+		buf = append(buf, make([]byte, chunk)...)
+		if _, err := io.ReadFull(p.r, buf[start:]); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		p.consumed(buf[start:])
+	}
+	return buf, nil
+}
+
+func min64(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+const (
+	rdbEncInt8  = 0
+	rdbEncInt16 = 1
+	rdbEncInt32 = 2
+	rdbEncLZF   = 3
+)
+
+// readLength returns a length, or an encoding type when encoded is true.
+func (p *rdbReader) readLength() (uint64, bool, error) {
+	b, err := p.readByte()
+	if err != nil {
+		return 0, false, err
+	}
+	switch b >> 6 {
+	case 0:
+		return uint64(b & 0x3F), false, nil
+	case 1:
+		b2, err := p.readByte()
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(b&0x3F)<<8 | uint64(b2), false, nil
+	case 2:
+		switch b {
+		case 0x80:
+			buf, err := p.readN(4)
+			if err != nil {
+				return 0, false, err
+			}
+			return uint64(binary.BigEndian.Uint32(buf)), false, nil
+		case 0x81:
+			buf, err := p.readN(8)
+			if err != nil {
+				return 0, false, err
+			}
+			return binary.BigEndian.Uint64(buf), false, nil
+		}
+		return 0, false, fmt.Errorf("bad length encoding 0x%02x at offset %d", b, p.pos-1)
+	}
+	return uint64(b & 0x3F), true, nil
+}
+
+func (p *rdbReader) readLen() (uint64, error) {
+	n, enc, err := p.readLength()
+	if err == nil && enc {
+		err = fmt.Errorf("unexpected encoded value at offset %d", p.pos-1)
+	}
+	return n, err
+}
+
+func (p *rdbReader) readString() ([]byte, error) {
+	n, enc, err := p.readLength()
+	if err != nil {
+		return nil, err
+	}
+	if !enc {
+		return p.readN(n)
+	}
+	switch n {
+	case rdbEncInt8:
+		b, err := p.readByte()
+		return []byte(strconv.Itoa(int(int8(b)))), err
+	case rdbEncInt16:
+		buf, err := p.readN(2)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strconv.Itoa(int(int16(binary.LittleEndian.Uint16(buf))))), nil
+	case rdbEncInt32:
+		buf, err := p.readN(4)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strconv.Itoa(int(int32(binary.LittleEndian.Uint32(buf))))), nil
+	case rdbEncLZF:
+		clen, err := p.readLen()
+		if err != nil {
+			return nil, err
+		}
+		ulen, err := p.readLen()
+		if err != nil {
+			return nil, err
+		}
+		if ulen > math.MaxInt32 {
+			return nil, fmt.Errorf("implausible LZF length %d", ulen)
+		}
+		data, err := p.readN(clen)
+		if err != nil {
+			return nil, err
+		}
+		return lzfDecompress(data, int(ulen))
+	}
+	return nil, fmt.Errorf("unknown string encoding %d at offset %d", n, p.pos)
+}
+
+// readDouble reads the old ASCII double format of RDB_TYPE_ZSET.
+func (p *rdbReader) readDouble() (float64, error) {
+	n, err := p.readByte()
+	if err != nil {
+		return 0, err
+	}
+	switch n {
+	case 253:
+		return math.NaN(), nil
+	case 254:
+		return math.Inf(1), nil
+	case 255:
+		return math.Inf(-1), nil
+	}
+	buf, err := p.readN(uint64(n))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(string(buf), 64)
+}
+
+func (p *rdbReader) readBinaryDouble() (float64, error) {
+	buf, err := p.readN(8)
+	if err != nil {
+		return 0, err
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(buf)), nil
+}
+
+func (p *rdbReader) readMillis() (int64, error) {
+	buf, err := p.readN(8)
+	if err != nil {
+		return 0, err
+	}
+	return int64(binary.LittleEndian.Uint64(buf)), nil
+}
+
+/*************** DUMP PAYLOAD ***************/
+
+// dumpPayload builds what DUMP would return for a captured key: type byte,
+// serialized value, 2-byte RDB version and CRC64 of all of it. RESTORE
+// accepts it on any Redis whose RDB version is not older.
+func dumpPayload(e *rdbEntry) []byte {
+	out := make([]byte, 0, len(e.Raw)+11)
+	out = append(out, e.Type)
+	out = append(out, e.Raw...)
+	out = append(out, byte(e.Version), byte(e.Version>>8))
+	var crc [8]byte
+	binary.LittleEndian.PutUint64(crc[:], crc64Update(0, out))
+	return append(out, crc[:]...)
+}
+
+/*************** TOP LEVEL ***************/
+
+// rdbCapture selects the keys whose serialized value parseRDB keeps in Raw.
+type rdbCapture int
+
+const (
+	captureNone    rdbCapture = iota
+	captureModules            // module values only, their decoded form is opaque
+	captureAll                // every key, e.g. to build DUMP payloads
+)
+
+// parseRDB reads a whole dump, calling fn for every key. Captured keys get
+// rdbEntry.Raw with the serialized value so it can be turned into a DUMP
+// payload. The trailing CRC64 is verified when present.
+func parseRDB(r io.Reader, capture rdbCapture, fn func(*rdbEntry) error) (rdbInfo, error) {
+	p := newRDBReader(r)
+	info := rdbInfo{Aux: make(map[string]string)}
+
+	magic, err := p.readN(9)
+	if err != nil {
+		return info, fmt.Errorf("reading header: %w", err)
+	}
+	if string(magic[:5]) != "REDIS" {
+		return info, errors.New("not an RDB file (bad magic)")
+	}
+	version, err := strconv.Atoi(string(magic[5:]))
+	if err != nil || version < 1 {
+		return info, fmt.Errorf("bad RDB version %q", magic[5:])
+	}
+	if version > rdbMaxVersion {
+		return info, fmt.Errorf("RDB version %d is newer than supported (%d)", version, rdbMaxVersion)
+	}
+	info.Version = version
+
+	seenModules := make(map[string]bool)
+	addModule := func(name string) {
+		if !seenModules[name] {
+			seenModules[name] = true
+			info.Modules = append(info.Modules, name)
+		}
+	}
+
+	db := 0
+	var expire int64
+	for {
+		op, err := p.readByte()
+		if err != nil {
+			return info, err
+		}
+		switch op {
+		case rdbOpEOF:
+			if version >= 5 {
+				expected := p.crc
+				buf := make([]byte, 8)
+				if _, err := io.ReadFull(p.r, buf); err != nil {
+					return info, fmt.Errorf("reading checksum: %w", unexpectedEOF(err))
+				}
+				p.pos += int64(len(buf))
+				info.Checksum = binary.LittleEndian.Uint64(buf)
+				if info.Checksum != 0 && info.Checksum != expected {
+					return info, fmt.Errorf("CRC64 mismatch: stored %016x, computed %016x", info.Checksum, expected)
+				}
+			}
+			info.Size = p.pos
+			return info, nil
+		case rdbOpSelectDB:
+			n, err := p.readLen()
+			if err != nil {
+				return info, err
+			}
+			db = int(n)
+		case rdbOpResizeDB:
+			if _, err := p.readLen(); err != nil {
+				return info, err
+			}
+			if _, err := p.readLen(); err != nil {
+				return info, err
+			}
+		case rdbOpSlotInfo:
+			for i := 0; i < 3; i++ {
+				if _, err := p.readLen(); err != nil {
+					return info, err
+				}
+			}
+		case rdbOpAux:
+			k, err := p.readString()
+			if err != nil {
+				return info, err
+			}
+			v, err := p.readString()
+			if err != nil {
+				return info, err
+			}
+			info.Aux[string(k)] = string(v)
+		case rdbOpModuleAux:
+			id, err := p.readLen()
+			if err != nil {
+				return info, err
+			}
+			addModule(moduleNameFromID(id))
+			whenOp, err := p.readLen()
+			if err != nil {
+				return info, err
+			}
+			if whenOp != rdbModuleOpUint {
+				return info, fmt.Errorf("bad module aux 'when' opcode %d", whenOp)
+			}
+			if _, err := p.readLen(); err != nil {
+				return info, err
+			}
+			if err := p.skipModuleValue(); err != nil {
+				return info, err
+			}
+		case rdbOpFunction2:
+			if _, err := p.readString(); err != nil {
+				return info, err
+			}
+		case rdbOpFunctionPreGA:
+			return info, errors.New("pre-GA function format (Redis 7.0 RC) is not supported")
+		case rdbOpExpireMs:
+			if expire, err = p.readMillis(); err != nil {
+				return info, err
+			}
+		case rdbOpExpire:
+			buf, err := p.readN(4)
+			if err != nil {
+				return info, err
+			}
+			expire = int64(binary.LittleEndian.Uint32(buf)) * 1000
+		case rdbOpIdle:
+			if _, err := p.readLen(); err != nil {
+				return info, err
+			}
+		case rdbOpFreq:
+			if _, err := p.readByte(); err != nil {
+				return info, err
+			}
+		default:
+			key, err := p.readString()
+			if err != nil {
+				return info, fmt.Errorf("key at offset %d: %w", p.pos, err)
+			}
+			e := &rdbEntry{DB: db, Key: key, Type: op, ExpireMs: expire, Version: version}
+			expire = 0
+
+			var buf bytes.Buffer
+			keep := capture == captureAll ||
+				capture == captureModules && (op == rdbTypeModule || op == rdbTypeModule2)
+			if keep {
+				p.capture = &buf
+			}
+			start := p.pos
+			e.Value, err = p.readValue(op)
+			p.capture = nil
+			if err != nil {
+				return info, fmt.Errorf("key %q (type %d): %w", key, op, err)
+			}
+			e.Size = p.pos - start
+			if keep {
+				e.Raw = buf.Bytes()
+			}
+			if m, ok := e.Value.(rdbModuleValue); ok {
+				addModule(m.Module)
+			}
+			info.Keys++
+			if fn != nil {
+				if err := fn(e); err != nil {
+					return info, err
+				}
+			}
+		}
+	}
+}
+
+func (p *rdbReader) readValue(t byte) (interface{}, error) {
+	switch t {
+	case rdbTypeString:
+		return p.readString()
+	case rdbTypeList, rdbTypeSet:
+		n, err := p.readLen()
+		if err != nil {
+			return nil, err
+		}
+		var out [][]byte
+		for i := uint64(0); i < n; i++ {
+			s, err := p.readString()
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, s)
+		}
+		return out, nil
+	case rdbTypeZset, rdbTypeZset2:
+		n, err := p.readLen()
+		if err != nil {
+			return nil, err
+		}
+		var out []zsetMember
+		for i := uint64(0); i < n; i++ {
+			m, err := p.readString()
+			if err != nil {
+				return nil, err
+			}
+			var score float64
+			if t == rdbTypeZset {
+				score, err = p.readDouble()
+			} else {
+				score, err = p.readBinaryDouble()
+			}
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, zsetMember{Member: m, Score: score})
+		}
+		return out, nil
+	case rdbTypeHash:
+		n, err := p.readLen()
+		if err != nil {
+			return nil, err
+		}
+		var out []hashField
+		for i := uint64(0); i < n; i++ {
+			f, err := p.readString()
+			if err != nil {
+				return nil, err
+			}
+			v, err := p.readString()
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, hashField{Field: f, Value: v})
+		}
+		return out, nil
+	case rdbTypeHashMetadataPreGA, rdbTypeHashMetadata:
+		return p.readHashMetadata(t)
+	case rdbTypeModule:
+		return nil, errors.New("module type v1 values cannot be parsed without the module")
+	case rdbTypeModule2:
+		id, err := p.readLen()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.skipModuleValue(); err != nil {
+			return nil, err
+		}
+		return rdbModuleValue{Module: moduleNameFromID(id)}, nil
+	case rdbTypeHashZipmap:
+		blob, err := p.readString()
+		if err != nil {
+			return nil, err
+		}
+		return decodeZipmap(blob)
+	case rdbTypeListZiplist:
+		blob, err := p.readString()
+		if err != nil {
+			return nil, err
+		}
+		return decodeZiplist(blob)
+	case rdbTypeSetIntset:
+		blob, err := p.readString()
+		if err != nil {
+			return nil, err
+		}
+		return decodeIntset(blob)
+	case rdbTypeSetListpack:
+		blob, err := p.readString()
+		if err != nil {
+			return nil, err
+		}
+		return decodeListpack(blob)
+	case rdbTypeZsetZiplist, rdbTypeZsetListpack:
+		blob, err := p.readString()
+		if err != nil {
+			return nil, err
+		}
+		items, err := decodePacked(t == rdbTypeZsetZiplist, blob)
+		if err != nil {
+			return nil, err
+		}
+		if len(items)%2 != 0 {
+			return nil, errors.New("odd number of zset elements")
+		}
+		var out []zsetMember
+		for i := 0; i < len(items); i += 2 {
+			score, err := strconv.ParseFloat(string(items[i+1]), 64)
+			if err != nil {
+				return nil, fmt.Errorf("bad zset score %q", items[i+1])
+			}
+			out = append(out, zsetMember{Member: items[i], Score: score})
+		}
+		return out, nil
+	case rdbTypeHashZiplist, rdbTypeHashListpack:
+		blob, err := p.readString()
+		if err != nil {
+			return nil, err
+		}
+		items, err := decodePacked(t == rdbTypeHashZiplist, blob)
+		if err != nil {
+			return nil, err
+		}
+		if len(items)%2 != 0 {
+			return nil, errors.New("odd number of hash elements")
+		}
+		var out []hashField
+		for i := 0; i < len(items); i += 2 {
+			out = append(out, hashField{Field: items[i], Value: items[i+1]})
+		}
+		return out, nil
+	case rdbTypeHashListpackExPre, rdbTypeHashListpackEx:
+		var minExpire int64
+		if t == rdbTypeHashListpackEx {
+			var err error
+			if minExpire, err = p.readMillis(); err != nil {
+				return nil, err
+			}
+		}
+		_ = minExpire // only a hint for the server's expiry scheduling
+		blob, err := p.readString()
+		if err != nil {
+			return nil, err
+		}
+		items, err := decodeListpack(blob)
+		if err != nil {
+			return nil, err
+		}
+		if len(items)%3 != 0 {
+			return nil, errors.New("bad field/value/ttl triplets")
+		}
+		var out []hashField
+		for i := 0; i < len(items); i += 3 {
+			ttl, _ := strconv.ParseInt(string(items[i+2]), 10, 64)
+			out = append(out, hashField{Field: items[i], Value: items[i+1], ExpireMs: ttl})
+		}
+		return out, nil
+	case rdbTypeListQuicklist, rdbTypeListQuicklist2:
+		n, err := p.readLen()
+		if err != nil {
+			return nil, err
+		}
+		var out [][]byte
+		for i := uint64(0); i < n; i++ {
+			container := uint64(2) // packed
+			if t == rdbTypeListQuicklist2 {
+				if container, err = p.readLen(); err != nil {
+					return nil, err
+				}
+			}
+			blob, err := p.readString()
+			if err != nil {
+				return nil, err
+			}
+			switch {
+			case container == 1: // plain node: one large element
+				out = append(out, blob)
+			case t == rdbTypeListQuicklist:
+				items, err := decodeZiplist(blob)
+				if err != nil {
+					return nil, err
+				}
+				out = append(out, items...)
+			default:
+				items, err := decodeListpack(blob)
+				if err != nil {
+					return nil, err
+				}
+				out = append(out, items...)
+			}
+		}
+		return out, nil
+	case rdbTypeStreamListpacks, rdbTypeStreamListpacks2, rdbTypeStreamListpacks3:
+		return p.readStream(t)
+	}
+	return nil, fmt.Errorf("unknown value type %d at offset %d", t, p.pos-1)
+}
+
+// readHashMetadata reads hashes with per-field TTLs (Redis 7.4+).
+func (p *rdbReader) readHashMetadata(t byte) ([]hashField, error) {
+	var minExpire int64
+	if t == rdbTypeHashMetadata {
+		var err error
+		if minExpire, err = p.readMillis(); err != nil {
+			return nil, err
+		}
+	}
+	n, err := p.readLen()
+	if err != nil {
+		return nil, err
+	}
+	var out []hashField
+	for i := uint64(0); i < n; i++ {
+		var ttl int64
+		if t == rdbTypeHashMetadata {
+			rel, err := p.readLen()
+			if err != nil {
+				return nil, err
+			}
+			if rel != 0 {
+				ttl = int64(rel) + minExpire - 1
+			}
+		} else if ttl, err = p.readMillis(); err != nil {
+			return nil, err
+		}
+		f, err := p.readString()
+		if err != nil {
+			return nil, err
+		}
+		v, err := p.readString()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, hashField{Field: f, Value: v, ExpireMs: ttl})
+	}
+	return out, nil
+}
+
+func (p *rdbReader) readStream(t byte) (*rdbStream, error) {
+	s := &rdbStream{}
+	nodes, err := p.readLen()
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < nodes; i++ {
+		master, err := p.readString()
+		if err != nil {
+			return nil, err
+		}
+		if len(master) != 16 {
+			return nil, fmt.Errorf("stream node key of %d bytes", len(master))
+		}
+		lp, err := p.readString()
+		if err != nil {
+			return nil, err
+		}
+		entries, err := decodeStreamListpack(master, lp)
+		if err != nil {
+			return nil, err
+		}
+		s.Entries = append(s.Entries, entries...)
+	}
+	if s.Length, err = p.readLen(); err != nil {
+		return nil, err
+	}
+	ms, err := p.readLen()
+	if err != nil {
+		return nil, err
+	}
+	seq, err := p.readLen()
+	if err != nil {
+		return nil, err
+	}
+	s.LastID = fmt.Sprintf("%d-%d", ms, seq)
+	if t >= rdbTypeStreamListpacks2 {
+		// first id, max deleted id, entries added
+		for i := 0; i < 5; i++ {
+			if _, err := p.readLen(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	groups, err := p.readLen()
+	if err != nil {
+		return nil, err
+	}
+	s.Groups = int(groups)
+	for g := uint64(0); g < groups; g++ {
+		if _, err := p.readString(); err != nil { // group name
+			return nil, err
+		}
+		for i := 0; i < 2; i++ { // last delivered id
+			if _, err := p.readLen(); err != nil {
+				return nil, err
+			}
+		}
+		if t >= rdbTypeStreamListpacks2 {
+			if _, err := p.readLen(); err != nil { // entries read
+				return nil, err
+			}
+		}
+		pel, err := p.readLen()
+		if err != nil {
+			return nil, err
+		}
+		for i := uint64(0); i < pel; i++ {
+			if _, err := p.readN(16 + 8); err != nil { // raw id + delivery time
+				return nil, err
+			}
+			if _, err := p.readLen(); err != nil { // delivery count
+				return nil, err
+			}
+		}
+		consumers, err := p.readLen()
+		if err != nil {
+			return nil, err
+		}
+		for c := uint64(0); c < consumers; c++ {
+			if _, err := p.readString(); err != nil {
+				return nil, err
+			}
+			times := uint64(8) // seen time
+			if t >= rdbTypeStreamListpacks3 {
+				times = 16 // + active time
+			}
+			if _, err := p.readN(times); err != nil {
+				return nil, err
+			}
+			cpel, err := p.readLen()
+			if err != nil {
+				return nil, err
+			}
+			if _, err := p.readN(cpel * 16); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return s, nil
+}
+
+// module serialization opcodes (RDB_MODULE_OPCODE_*)
+const (
+	rdbModuleOpEOF    = 0
+	rdbModuleOpSint   = 1
+	rdbModuleOpUint   = 2
+	rdbModuleOpFloat  = 3
+	rdbModuleOpDouble = 4
+	rdbModuleOpString = 5
+)
+
+// skipModuleValue walks self-describing module data up to its EOF opcode.
+func (p *rdbReader) skipModuleValue() error {
+	for {
+		op, err := p.readLen()
+		if err != nil {
+			return err
+		}
+		switch op {
+		case rdbModuleOpEOF:
+			return nil
+		case rdbModuleOpSint, rdbModuleOpUint:
+			_, err = p.readLen()
+		case rdbModuleOpFloat:
+			_, err = p.readN(4)
+		case rdbModuleOpDouble:
+			_, err = p.readN(8)
+		case rdbModuleOpString:
+			_, err = p.readString()
+		default:
+			return fmt.Errorf("unknown module opcode %d", op)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+const moduleNameCharset = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+
+// moduleNameFromID decodes the 9-char module type name from a 64-bit module id.
+func moduleNameFromID(id uint64) string {
+	name := make([]byte, 9)
+	rest := id >> 10
+	for j := 8; j >= 0; j-- {
+		name[j] = moduleNameCharset[rest&63]
+		rest >>= 6
+	}
+	return string(name)
+}
+
+/*************** PACKED ENCODINGS ***************/
+
+func decodePacked(ziplist bool, blob []byte) ([][]byte, error) {
+	if ziplist {
+		return decodeZiplist(blob)
+	}
+	return decodeListpack(blob)
+}
+
+func decodeZiplist(b []byte) ([][]byte, error) {
+	if len(b) < 11 {
+		return nil, errors.New("ziplist too short")
+	}
+	if int(binary.LittleEndian.Uint32(b)) != len(b) {
+		return nil, errors.New("ziplist size mismatch")
+	}
+	pos := 10
+	var out [][]byte
+	for {
+		if pos >= len(b) {
+			return nil, errors.New("ziplist without end marker")
+		}
+		if b[pos] == 0xFF {
+			return out, nil
+		}
+		// previous entry length
+		if b[pos] == 0xFE {
+			pos += 5
+		} else {
+			pos++
+		}
+		if pos >= len(b) {
+			return nil, errors.New("truncated ziplist entry")
+		}
+		enc := b[pos]
+		need := func(n int) error {
+			if pos+n > len(b) {
+				return errors.New("truncated ziplist entry")
+			}
+			return nil
+		}
+		switch {
+		case enc>>6 == 0:
+			n := int(enc & 0x3F)
+			pos++
+			if err := need(n); err != nil {
+				return nil, err
+			}
+			out = append(out, b[pos:pos+n])
+			pos += n
+		case enc>>6 == 1:
+			if err := need(2); err != nil {
+				return nil, err
+			}
+			n := int(enc&0x3F)<<8 | int(b[pos+1])
+			pos += 2
+			if err := need(n); err != nil {
+				return nil, err
+			}
+			out = append(out, b[pos:pos+n])
+			pos += n
+		case enc == 0x80:
+			if err := need(5); err != nil {
+				return nil, err
+			}
+			n := int(binary.BigEndian.Uint32(b[pos+1:]))
+			pos += 5
+			if n < 0 || pos+n > len(b) {
+				return nil, errors.New("truncated ziplist entry")
+			}
+			out = append(out, b[pos:pos+n])
+			pos += n
+		case enc == 0xC0:
+			if err := need(3); err != nil {
+				return nil, err
+			}
+			out = append(out, []byte(strconv.Itoa(int(int16(binary.LittleEndian.Uint16(b[pos+1:]))))))
+			pos += 3
+		case enc == 0xD0:
+			if err := need(5); err != nil {
+				return nil, err
+			}
+			out = append(out, []byte(strconv.Itoa(int(int32(binary.LittleEndian.Uint32(b[pos+1:]))))))
+			pos += 5
+		case enc == 0xE0:
+			if err := need(9); err != nil {
+				return nil, err
+			}
+			out = append(out, []byte(strconv.FormatInt(int64(binary.LittleEndian.Uint64(b[pos+1:])), 10)))
+			pos += 9
+		case enc == 0xF0:
+			if err := need(4); err != nil {
+				return nil, err
+			}
+			v := int32(uint32(b[pos+1])<<8|uint32(b[pos+2])<<16|uint32(b[pos+3])<<24) >> 8
+			out = append(out, []byte(strconv.Itoa(int(v))))
+			pos += 4
+		case enc == 0xFE:
+			if err := need(2); err != nil {
+				return nil, err
+			}
+			out = append(out, []byte(strconv.Itoa(int(int8(b[pos+1])))))
+			pos += 2
+		case enc >= 0xF1 && enc <= 0xFD:
+			out = append(out, []byte(strconv.Itoa(int(enc&0x0F)-1)))
+			pos++
+		default:
+			return nil, fmt.Errorf("bad ziplist encoding 0x%02x", enc)
+		}
+	}
+}
+
+func decodeListpack(b []byte) ([][]byte, error) {
+	if len(b) < 7 {
+		return nil, errors.New("listpack too short")
+	}
+	if int(binary.LittleEndian.Uint32(b)) != len(b) {
+		return nil, errors.New("listpack size mismatch")
+	}
+	pos := 6
+	var out [][]byte
+	for {
+		if pos >= len(b) {
+			return nil, errors.New("listpack without end marker")
+		}
+		if b[pos] == 0xFF {
+			return out, nil
+		}
+		v, n, err := listpackEntry(b[pos:])
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+		pos += n
+	}
+}
+
+// listpackEntry decodes one element and returns it with its total length (incl. backlen).
+func listpackEntry(b []byte) ([]byte, int, error) {
+	enc := b[0]
+	var v []byte
+	var l int // encoding + data
+	need := func(n int) error {
+		if n > len(b) {
+			return errors.New("truncated listpack entry")
+		}
+		return nil
+	}
+	switch {
+	case enc&0x80 == 0:
+		v, l = []byte(strconv.Itoa(int(enc&0x7F))), 1
+	case enc&0xC0 == 0x80:
+		n := int(enc & 0x3F)
+		if err := need(1 + n); err != nil {
+			return nil, 0, err
+		}
+		v, l = b[1:1+n], 1+n
+	case enc&0xE0 == 0xC0:
+		if err := need(2); err != nil {
+			return nil, 0, err
+		}
+		u := int(enc&0x1F)<<8 | int(b[1])
+		if u >= 1<<12 {
+			u -= 1 << 13
+		}
+		v, l = []byte(strconv.Itoa(u)), 2
+	case enc&0xF0 == 0xE0:
+		if err := need(2); err != nil {
+			return nil, 0, err
+		}
+		n := int(enc&0x0F)<<8 | int(b[1])
+		if err := need(2 + n); err != nil {
+			return nil, 0, err
+		}
+		v, l = b[2:2+n], 2+n
+	case enc == 0xF0:
+		if err := need(5); err != nil {
+			return nil, 0, err
+		}
+		n := int(binary.LittleEndian.Uint32(b[1:]))
+		if n < 0 || 5+n > len(b) {
+			return nil, 0, errors.New("truncated listpack entry")
+		}
+		v, l = b[5:5+n], 5+n
+	case enc == 0xF1:
+		if err := need(3); err != nil {
+			return nil, 0, err
+		}
+		v, l = []byte(strconv.Itoa(int(int16(binary.LittleEndian.Uint16(b[1:]))))), 3
+	case enc == 0xF2:
+		if err := need(4); err != nil {
+			return nil, 0, err
+		}
+		x := int32(uint32(b[1])<<8|uint32(b[2])<<16|uint32(b[3])<<24) >> 8
+		v, l = []byte(strconv.Itoa(int(x))), 4
+	case enc == 0xF3:
+		if err := need(5); err != nil {
+			return nil, 0, err
+		}
+		v, l = []byte(strconv.Itoa(int(int32(binary.LittleEndian.Uint32(b[1:]))))), 5
+	case enc == 0xF4:
+		if err := need(9); err != nil {
+			return nil, 0, err
+		}
+		v, l = []byte(strconv.FormatInt(int64(binary.LittleEndian.Uint64(b[1:])), 10)), 9
+	default:
+		return nil, 0, fmt.Errorf("bad listpack encoding 0x%02x", enc)
+	}
+	back := 1
+	switch {
+	case l >= 268435456:
+		back = 5
+	case l >= 2097152:
+		back = 4
+	case l >= 16384:
+		back = 3
+	case l >= 128:
+		back = 2
+	}
+	if err := need(l + back); err != nil {
+		return nil, 0, err
+	}
+	return v, l + back, nil
+}
+
+func decodeIntset(b []byte) ([][]byte, error) {
+	if len(b) < 8 {
+		return nil, errors.New("intset too short")
+	}
+	width := int(binary.LittleEndian.Uint32(b))
+	n := int(binary.LittleEndian.Uint32(b[4:]))
+	if width != 2 && width != 4 && width != 8 {
+		return nil, fmt.Errorf("bad intset encoding %d", width)
+	}
+	if n < 0 || 8+n*width != len(b) {
+		return nil, errors.New("intset size mismatch")
+	}
+	out := make([][]byte, 0, n)
+	for i := 0; i < n; i++ {
+		at := b[8+i*width:]
+		var v int64
+		switch width {
+		case 2:
+			v = int64(int16(binary.LittleEndian.Uint16(at)))
+		case 4:
+			v = int64(int32(binary.LittleEndian.Uint32(at)))
+		case 8:
+			v = int64(binary.LittleEndian.Uint64(at))
+		}
+		out = append(out, []byte(strconv.FormatInt(v, 10)))
+	}
+	return out, nil
+}
+
+func decodeZipmap(b []byte) ([]hashField, error) {
+	if len(b) < 2 {
+		return nil, errors.New("zipmap too short")
+	}
+	pos := 1
+	readLen := func() (int, error) {
+		if pos >= len(b) {
+			return 0, errors.New("truncated zipmap")
+		}
+		switch c := b[pos]; {
+		case c < 254:
+			pos++
+			return int(c), nil
+		case c == 254:
+			if pos+5 > len(b) {
+				return 0, errors.New("truncated zipmap")
+			}
+			n := int(binary.LittleEndian.Uint32(b[pos+1:]))
+			pos += 5
+			return n, nil
+		}
+		return -1, nil // end marker
+	}
+	var out []hashField
+	for {
+		kl, err := readLen()
+		if err != nil {
+			return nil, err
+		}
+		if kl < 0 {
+			return out, nil
+		}
+		if pos+kl > len(b) {
+			return nil, errors.New("truncated zipmap")
+		}
+		key := b[pos : pos+kl]
+		pos += kl
+		vl, err := readLen()
+		if err != nil || vl < 0 {
+			return nil, errors.New("truncated zipmap")
+		}
+		if pos >= len(b) {
+			return nil, errors.New("truncated zipmap")
+		}
+		free := int(b[pos])
+		pos++
+		if pos+vl+free > len(b) {
+			return nil, errors.New("truncated zipmap")
+		}
+		out = append(out, hashField{Field: key, Value: b[pos : pos+vl]})
+		pos += vl + free
+	}
+}
+
+// stream entry flags
+const (
+	streamFlagDeleted    = 1
+	streamFlagSameFields = 2
+)
+
+// decodeStreamListpack expands one stream node: a master entry with the
+// shared field names, then entries stored as deltas from the node's master ID.
+func decodeStreamListpack(master, lp []byte) ([]streamEntry, error) {
+	items, err := decodeListpack(lp)
+	if err != nil {
+		return nil, err
+	}
+	masterMs := binary.BigEndian.Uint64(master)
+	masterSeq := binary.BigEndian.Uint64(master[8:])
+
+	pos := 0
+	next := func() (int64, error) {
+		if pos >= len(items) {
+			return 0, errors.New("truncated stream node")
+		}
+		v, err := strconv.ParseInt(string(items[pos]), 10, 64)
+		pos++
+		return v, err
+	}
+	nextRaw := func() ([]byte, error) {
+		if pos >= len(items) {
+			return nil, errors.New("truncated stream node")
+		}
+		pos++
+		return items[pos-1], nil
+	}
+
+	count, err := next()
+	if err != nil {
+		return nil, err
+	}
+	deleted, err := next()
+	if err != nil {
+		return nil, err
+	}
+	nfields, err := next()
+	if err != nil {
+		return nil, err
+	}
+	masterFields := make([][]byte, 0, nfields)
+	for i := int64(0); i < nfields; i++ {
+		f, err := nextRaw()
+		if err != nil {
+			return nil, err
+		}
+		masterFields = append(masterFields, f)
+	}
+	if _, err := next(); err != nil { // master terminator
+		return nil, err
+	}
+
+	var out []streamEntry
+	for i := int64(0); i < count+deleted; i++ {
+		flags, err := next()
+		if err != nil {
+			return nil, err
+		}
+		msDiff, err := next()
+		if err != nil {
+			return nil, err
+		}
+		seqDiff, err := next()
+		if err != nil {
+			return nil, err
+		}
+		e := streamEntry{ID: fmt.Sprintf("%d-%d", masterMs+uint64(msDiff), masterSeq+uint64(seqDiff))}
+		if flags&streamFlagSameFields != 0 {
+			for _, f := range masterFields {
+				v, err := nextRaw()
+				if err != nil {
+					return nil, err
+				}
+				e.Fields = append(e.Fields, [2][]byte{f, v})
+			}
+		} else {
+			n, err := next()
+			if err != nil {
+				return nil, err
+			}
+			for j := int64(0); j < n; j++ {
+				f, err := nextRaw()
+				if err != nil {
+					return nil, err
+				}
+				v, err := nextRaw()
+				if err != nil {
+					return nil, err
+				}
+				e.Fields = append(e.Fields, [2][]byte{f, v})
+			}
+		}
+		if _, err := next(); err != nil { // lp-count of the entry
+			return nil, err
+		}
+		if flags&streamFlagDeleted == 0 {
+			out = append(out, e)
+		}
+	}
+	return out, nil
+}
+
+/*************** LZF ***************/
+
+func lzfDecompress(in []byte, outLen int) ([]byte, error) {
+	out := make([]byte, 0, outLen)
+	i := 0
+	for i < len(in) {
+		ctrl := int(in[i])
+		i++
+		if ctrl < 32 { // literal run
+			n := ctrl + 1
+			if i+n > len(in) {
+				return nil, errors.New("lzf: truncated literal")
+			}
+			out = append(out, in[i:i+n]...)
+			i += n
+			continue
+		}
+		n := ctrl >> 5
+		if n == 7 {
+			if i >= len(in) {
+				return nil, errors.New("lzf: truncated length")
+			}
+			n += int(in[i])
+			i++
+		}
+		if i >= len(in) {
+			return nil, errors.New("lzf: truncated reference")
+		}
+		ref := len(out) - ((ctrl & 0x1F) << 8) - int(in[i]) - 1
+		i++
+		if ref < 0 {
+			return nil, errors.New("lzf: invalid back reference")
+		}
+		for j := 0; j < n+2; j++ {
+			out = append(out, out[ref+j])
+		}
+	}
+	if len(out) != outLen {
+		return nil, fmt.Errorf("lzf: got %d bytes, expected %d", len(out), outLen)
+	}
+	return out, nil
+}
+
+/*************** CRC64 ***************/
+// Redis uses CRC-64/Jones (reflected, init 0, no final xor); hash/crc64
+// inverts the register, so the table is built here.
+
+var crc64Table = func() *[256]uint64 {
+	const poly = 0x95ac9329ac4bc9b5 // 0xad93d23594c935a9 bit-reversed
+	var t [256]uint64
+	for i := range t {
+		crc := uint64(i)
+		for j := 0; j < 8; j++ {
+			if crc&1 == 1 {
+				crc = crc>>1 ^ poly
+			} else {
+				crc >>= 1
+			}
+		}
+		t[i] = crc
+	}
+	return &t
+}()
+
+func crc64Update(crc uint64, p []byte) uint64 {
+	for _, b := range p {
+		crc = crc64Table[byte(crc)^b] ^ crc>>8
+	}
+	return crc
+}
+
+/*************** ARCHIVE CHECK ***************/
+
+// verifyArchiveRDB parses the whole dump inside an archive, including its CRC64.
+func verifyArchiveRDB(path string) (rdbInfo, error) {
+	a, err := openArchivedRDB(path)
+	if err != nil {
+		return rdbInfo{}, err
+	}
+	defer a.Close()
+
+	info, err := parseRDB(a, captureNone, nil)
+	if err != nil {
+		return info, err
+	}
+	if info.Size != a.Size {
+		return info, fmt.Errorf("%d trailing bytes after EOF marker", a.Size-info.Size)
+	}
+	// reading on checks the entries after the dump
+	if _, err := io.Copy(io.Discard, a); err != nil {
+		return info, err
+	}
+	return info, nil
+}
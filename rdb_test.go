@@ -0,0 +1,257 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// emptyRDB returns a minimal version 9 dump: header, EOF marker and CRC64.
+func emptyRDB() []byte {
+	data := append([]byte("REDIS0009"), rdbOpEOF)
+	sum := make([]byte, 8)
+	binary.LittleEndian.PutUint64(sum, crc64Update(0, data))
+	return append(data, sum...)
+}
+
+func TestVerifyArchiveRDB(t *testing.T) {
+	good := writeTestArchive(t, regularEntry("dump.rdb", emptyRDB()))
+	info, err := verifyArchiveRDB(good)
+	if err != nil {
+		t.Fatalf("clean archive: %v", err)
+	}
+	if info.Size != int64(len(emptyRDB())) {
+		t.Errorf("Size = %d, want %d", info.Size, len(emptyRDB()))
+	}
+
+	garbage := append(emptyRDB(), "trailing garbage"...)
+	bad := writeTestArchive(t, regularEntry("dump.rdb", garbage))
+	_, err = verifyArchiveRDB(bad)
+	if err == nil || !strings.Contains(err.Error(), "16 trailing bytes") {
+		t.Fatalf("trailing garbage: got %v, want a trailing bytes error", err)
+	}
+}
+
+/*************** ENCODING FIXTURES ***************/
+
+// rdbStr encodes a short plain string.
+func rdbStr(s string) []byte {
+	return append([]byte{byte(len(s))}, s...)
+}
+
+// rdbDump wraps one key of type typ with the given serialized value in a dump.
+func rdbDump(version int, typ byte, key string, value []byte) []byte {
+	data := []byte(fmt.Sprintf("REDIS%04d", version))
+	data = append(data, rdbOpSelectDB, 0, typ)
+	data = append(data, rdbStr(key)...)
+	data = append(data, value...)
+	data = append(data, rdbOpEOF)
+	sum := make([]byte, 8)
+	binary.LittleEndian.PutUint64(sum, crc64Update(0, data))
+	return append(data, sum...)
+}
+
+// ziplist packs short strings and ints 0..12 (the immediate encoding).
+func ziplist(items ...interface{}) []byte {
+	var body []byte
+	prev, tail := 0, 10
+	for _, it := range items {
+		tail = 10 + len(body)
+		e := []byte{byte(prev)}
+		switch v := it.(type) {
+		case string:
+			e = append(append(e, byte(len(v))), v...)
+		case int:
+			e = append(e, 0xF1+byte(v))
+		}
+		body = append(body, e...)
+		prev = len(e)
+	}
+	b := make([]byte, 10, 11+len(body))
+	binary.LittleEndian.PutUint32(b, uint32(11+len(body)))
+	binary.LittleEndian.PutUint32(b[4:], uint32(tail))
+	binary.LittleEndian.PutUint16(b[8:], uint16(len(items)))
+	return append(append(b, body...), 0xFF)
+}
+
+// listpack packs short strings, ints 0..127 and other int64 values.
+func listpack(items ...interface{}) []byte {
+	var body []byte
+	for _, it := range items {
+		var e []byte
+		switch v := it.(type) {
+		case string:
+			e = append([]byte{0x80 | byte(len(v))}, v...)
+		case int:
+			e = []byte{byte(v)}
+		case int64:
+			e = make([]byte, 9)
+			e[0] = 0xF4
+			binary.LittleEndian.PutUint64(e[1:], uint64(v))
+		}
+		body = append(append(body, e...), byte(len(e)))
+	}
+	b := make([]byte, 6, 7+len(body))
+	binary.LittleEndian.PutUint32(b, uint32(7+len(body)))
+	binary.LittleEndian.PutUint16(b[4:], uint16(len(items)))
+	return append(append(b, body...), 0xFF)
+}
+
+func intset(values ...int16) []byte {
+	b := make([]byte, 8+2*len(values))
+	binary.LittleEndian.PutUint32(b, 2)
+	binary.LittleEndian.PutUint32(b[4:], uint32(len(values)))
+	for i, v := range values {
+		binary.LittleEndian.PutUint16(b[8+2*i:], uint16(v))
+	}
+	return b
+}
+
+// blob stores packed data as a length-prefixed string.
+func blob(b []byte) []byte {
+	return append([]byte{0x40 | byte(len(b)>>8), byte(len(b))}, b...)
+}
+
+func millis(ms int64) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, uint64(ms))
+	return b
+}
+
+// moduleID encodes a module type name and version as the 64-bit length
+// that precedes a module value.
+func moduleID(name string, encver uint64) []byte {
+	var id uint64
+	for i := 0; i < len(name); i++ {
+		id = id<<6 | uint64(strings.IndexByte(moduleNameCharset, name[i]))
+	}
+	b := make([]byte, 9)
+	b[0] = 0x81
+	binary.BigEndian.PutUint64(b[1:], id<<10|encver)
+	return b
+}
+
+func cat(parts ...[]byte) []byte {
+	var out []byte
+	for _, p := range parts {
+		out = append(out, p...)
+	}
+	return out
+}
+
+func bs(items ...string) [][]byte {
+	out := make([][]byte, len(items))
+	for i, s := range items {
+		out[i] = []byte(s)
+	}
+	return out
+}
+
+func TestParseRDBEncodings(t *testing.T) {
+	const ttl = int64(1735700000000)
+	master := make([]byte, 16)
+	binary.BigEndian.PutUint64(master, 1000)
+
+	tests := []struct {
+		name    string
+		version int
+		typ     byte
+		value   []byte
+		want    interface{}
+	}{
+		{"list ziplist", 9, rdbTypeListZiplist, blob(ziplist("a", "bc", 5)), bs("a", "bc", "5")},
+		{"hash ziplist", 9, rdbTypeHashZiplist, blob(ziplist("f", "v")),
+			[]hashField{{Field: []byte("f"), Value: []byte("v")}}},
+		{"set listpack", 11, rdbTypeSetListpack, blob(listpack("x", 7)), bs("x", "7")},
+		{"zset listpack", 10, rdbTypeZsetListpack, blob(listpack("m", 3)),
+			[]zsetMember{{Member: []byte("m"), Score: 3}}},
+		{"hash listpack", 10, rdbTypeHashListpack, blob(listpack("f", "v")),
+			[]hashField{{Field: []byte("f"), Value: []byte("v")}}},
+		{"set intset", 9, rdbTypeSetIntset, blob(intset(-2, 300)), bs("-2", "300")},
+		{"list quicklist2", 10, rdbTypeListQuicklist2,
+			cat([]byte{2}, []byte{2}, blob(listpack("a", "b")), []byte{1}, rdbStr("plain")),
+			bs("a", "b", "plain")},
+		{"stream", 9, rdbTypeStreamListpacks,
+			cat([]byte{1}, rdbStr(string(master)),
+				// count, deleted, fields, "f", terminator, then one entry with the master fields
+				blob(listpack(1, 0, 1, "f", 0, streamFlagSameFields, 0, 1, "v", 4)),
+				[]byte{1, 0x40 | 1000>>8, 1000 & 0xFF, 1, 0}),
+			&rdbStream{Entries: []streamEntry{{ID: "1000-1", Fields: [][2][]byte{{[]byte("f"), []byte("v")}}}},
+				Length: 1, LastID: "1000-1"}},
+		{"hash with field TTL", 12, rdbTypeHashMetadata,
+			cat(millis(ttl), []byte{2}, []byte{0}, rdbStr("a"), rdbStr("1"), []byte{11}, rdbStr("b"), rdbStr("2")),
+			[]hashField{{Field: []byte("a"), Value: []byte("1")}, {Field: []byte("b"), Value: []byte("2"), ExpireMs: ttl + 10}}},
+		{"hash listpack with field TTL", 12, rdbTypeHashListpackEx,
+			cat(millis(ttl), blob(listpack("a", "1", 0, "b", "2", ttl))),
+			[]hashField{{Field: []byte("a"), Value: []byte("1")}, {Field: []byte("b"), Value: []byte("2"), ExpireMs: ttl}}},
+		{"module", 9, rdbTypeModule2,
+			cat(moduleID("testmodul", 1), []byte{rdbModuleOpUint, 42, rdbModuleOpString}, rdbStr("state"), []byte{rdbModuleOpEOF}),
+			rdbModuleValue{Module: "testmodul"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got *rdbEntry
+			info, err := parseRDB(bytes.NewReader(rdbDump(tt.version, tt.typ, "k", tt.value)), captureNone, func(e *rdbEntry) error {
+				got = e
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("parseRDB: %v", err)
+			}
+			if info.Keys != 1 || got == nil {
+				t.Fatalf("parsed %d keys, want 1", info.Keys)
+			}
+			if got.Size != int64(len(tt.value)) {
+				t.Errorf("Size = %d, want %d", got.Size, len(tt.value))
+			}
+			if !reflect.DeepEqual(got.Value, tt.want) {
+				t.Errorf("Value = %#v, want %#v", got.Value, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRDBCapture(t *testing.T) {
+	module := cat(moduleID("testmodul", 1), []byte{rdbModuleOpEOF})
+	plain := rdbStr("value")
+
+	tests := []struct {
+		name    string
+		typ     byte
+		value   []byte
+		capture rdbCapture
+		raw     bool
+	}{
+		{"none, string", rdbTypeString, plain, captureNone, false},
+		{"modules, string", rdbTypeString, plain, captureModules, false},
+		{"modules, module", rdbTypeModule2, module, captureModules, true},
+		{"all, string", rdbTypeString, plain, captureAll, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var raw []byte
+			info, err := parseRDB(bytes.NewReader(rdbDump(9, tt.typ, "k", tt.value)), tt.capture, func(e *rdbEntry) error {
+				raw = e.Raw
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.raw && !bytes.Equal(raw, tt.value) {
+				t.Errorf("Raw = %q, want %q", raw, tt.value)
+			}
+			if !tt.raw && raw != nil {
+				t.Errorf("Raw = %q, want none", raw)
+			}
+			if tt.typ == rdbTypeModule2 && !reflect.DeepEqual(info.Modules, []string{"testmodul"}) {
+				t.Errorf("Modules = %v", info.Modules)
+			}
+		})
+	}
+}
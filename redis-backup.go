@@ -7,7 +7,10 @@ import (
 	"archive/tar"
 	"bufio"
 	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -47,6 +50,41 @@ var (
 	// other runtime flags
 	excludePortsCSV string
 	checkHours      int
+	checkRDB        bool // parse the newest archive of every instance in check mode
+
+	// sub-command options
+	targetPort       string // Redis instance a command works on
+	outputFormat     string // command specific output format
+	filterDB         int    // only this database, -1 = all
+	keyPattern       string // only keys matching this glob
+	onConflict       string // restore-keys: replace, skip or rename
+	renamePrefix     string // restore-keys: prefix for renamed keys
+	dryRun           bool   // only report what would be done
+	redisServerBin   string // redis-server used for sandboxes
+	loadTimeoutSec   int    // how long Redis may take to load a dump
+	checkTestDays    int    // check mode: max days since the last test restore
+	reportTop        int    // report: number of biggest keys / prefixes
+	prefixDelimiter  string // report: separator ending a key prefix
+	forceVersion     bool   // restore even if the RDB looks too new for the target
+	atTime           string // point in time to restore to
+	outputFile       string // pitr: where to write the resulting RDB
+	intoPort         string // instance that receives restored data, if not --port
+	restoreTier      string // restore: backup tier to pick archives from
+	restoreLatest    bool   // restore: use the newest archive
+	assumeYes        bool   // restore: do not ask, just do it
+	fromFTP          bool   // list/restore: use the FTP replicas instead of the local tree
+	sourceHost       string // list/restore: host whose backups are used (default: this one)
+	stopCmd          string // restore: service command stopping an instance
+	startCmd         string // restore: service command starting an instance
+	keepSnapshots    int    // restore: pre-restore snapshots kept per instance
+	archiveSnapshots bool   // restore: also archive pre-restore snapshots
+	skipUnchanged    bool   // record a marker instead of a new archive when the RDB did not change
+	volumeSizeMB     int    // split archives into volumes of this size (0 = single file)
+
+	// signing
+	signKeyFile   string // Ed25519 private key; archives are signed when it exists
+	verifyKeyFile string // public key for verification (default: <sign-key>.pub)
+	sigPolicy     string // off | warn | require
 )
 
 type ftpAccount struct {
@@ -72,11 +110,20 @@ const (
 const lockFile = "/tmp/redis_backup.lock"
 const backupSubdir = "redis-backup"
 
+// partialSuffix is appended to files while they are being written; they are
+// renamed into place only once complete, so readers never see a torn archive.
+const partialSuffix = ".partial"
+
+// unchangedSuffix marks a lightweight entry written instead of an archive
+// when the snapshot is byte-identical to the previous one.
+const unchangedSuffix = ".unchanged"
+
 func main() {
 	// Define flags
 	listFlag := flag.Bool("list", false, "List backups and exit")
 	restoreFlag := flag.Bool("restore", false, "Interactive restore wizard")
 	helpFlag := flag.Bool("help", false, "Show help and exit")
+	genKeyFlag := flag.Bool("gen-sign-key", false, "Generate an Ed25519 signing key at --sign-key and exit")
 
 	flag.StringVar(&backupPath, "backup-path", "/backup", "Root directory for backups")
 	flag.IntVar(&keepDays, "days", 30, "Days to keep daily backups (local)")
@@ -88,6 +135,34 @@ func main() {
 	// New: exclusion list and check
 	flag.StringVar(&excludePortsCSV, "exclude-ports", "", "Comma-separated list of Redis ports to skip during backup/check")
 	flag.IntVar(&checkHours, "check", 0, "Run integrity check; value = max allowed hours since last backup. 0 disables check mode.")
+	flag.StringVar(&targetPort, "port", "", "Redis port a command works on")
+	flag.StringVar(&outputFormat, "format", "", "Output format of a command (diff: summary|detailed, export: jsonl|resp, report: table|csv|json)")
+	flag.IntVar(&filterDB, "db", -1, "Only keys of this database (export, restore-keys, report)")
+	flag.StringVar(&keyPattern, "match", "", "Only keys matching this glob, Redis syntax (export, restore-keys, report)")
+	flag.StringVar(&onConflict, "on-conflict", conflictSkip, "restore-keys: what to do with keys that exist: replace, skip or rename")
+	flag.StringVar(&renamePrefix, "rename-prefix", "restored:", "restore-keys: prefix for keys restored next to an existing one (--on-conflict rename)")
+	flag.BoolVar(&dryRun, "dry-run", false, "Show what would be done without changing anything")
+	flag.IntVar(&reportTop, "top", 20, "report: number of biggest keys and prefixes to show")
+	flag.StringVar(&prefixDelimiter, "delimiter", ":", "report: delimiter that ends a key prefix")
+	flag.BoolVar(&forceVersion, "force-version", false, "Restore even if the target Redis seems too old for the archived RDB version")
+	flag.StringVar(&atTime, "at", "", "Point in time, e.g. \"2025-01-01 12:34\" (pitr; restore: newest snapshot at or before it)")
+	flag.StringVar(&outputFile, "output", "", "pitr: write the restored dataset to this RDB file")
+	flag.StringVar(&intoPort, "target-port", "", "pitr, restore: instance that receives the data (default: --port)")
+	flag.StringVar(&restoreTier, "tier", "", "restore: only take archives from this tier (daily, weekly, monthly, yearly; default: all)")
+	flag.BoolVar(&restoreLatest, "latest", false, "restore: use the newest local archive of --port (with --from-ftp: on FTP)")
+	flag.BoolVar(&assumeYes, "yes", false, "restore: do not ask for confirmation")
+	flag.BoolVar(&fromFTP, "from-ftp", false, "--list, --restore, restore: use the archives on the FTP accounts")
+	flag.StringVar(&sourceHost, "source-host", "", "--list, --restore, restore, pitr and the --port forms of the archive commands: use the backups taken on this host (default: this machine)")
+	flag.StringVar(&stopCmd, "stop-cmd", "", "Command that stops a Redis instance for a restore, {port} is replaced (default: SHUTDOWN NOSAVE)")
+	flag.StringVar(&startCmd, "start-cmd", "", "Command that starts a Redis instance after a restore, {port} is replaced (default: relaunch redis-server)")
+	flag.IntVar(&keepSnapshots, "keep-snapshots", 3, "restore, rollback: pre-restore snapshots of the replaced RDB to keep per instance (0 = all)")
+	flag.BoolVar(&archiveSnapshots, "archive-snapshot", false, "restore, rollback: also archive the pre-restore snapshot into <instance>/pre-restore")
+	flag.StringVar(&redisServerBin, "redis-server", "redis-server", "redis-server binary for test restores")
+	flag.IntVar(&loadTimeoutSec, "load-timeout", 600, "Seconds to wait until Redis has loaded a restored dump")
+	flag.IntVar(&checkTestDays, "check-restore-test", 0, "In check mode warn if no archive of an instance was test-restored within <n> days (0 = off)")
+	flag.BoolVar(&checkRDB, "check-rdb", false, "In check mode also parse the newest archived RDB of every instance (opcodes + CRC64)")
+	flag.IntVar(&volumeSizeMB, "volume-size", 0, "Split archives into volumes of <n> MB (0 = single file)")
+	flag.BoolVar(&skipUnchanged, "skip-unchanged", false, "Do not archive an RDB identical to the latest backup, record an 'unchanged' entry instead")
 
 	// New: FTP options
 	flag.StringVar(&ftpConfFile, "ftp-conf", "/etc/ftp-backup.conf", "Path to FTP credentials file")
@@ -96,8 +171,19 @@ func main() {
 	flag.StringVar(&ftpPass, "ftp-pass", "", "Override FTP password (otherwise taken from conf file)")
 	flag.IntVar(&ftpKeepFactor, "ftp-keep-factor", 4, "Retention multiplier for FTP (remoteKeepDays = keepDays * factor)")
 
+	// New: archive signing
+	flag.StringVar(&signKeyFile, "sign-key", "/etc/redis-backup/sign.key", "Ed25519 private key used to sign archives (signing is skipped if missing)")
+	flag.StringVar(&verifyKeyFile, "verify-key", "", "Ed25519 public key for verification (default: <sign-key>.pub)")
+	flag.StringVar(&sigPolicy, "sig-policy", sigPolicyWarn, "Missing/invalid signature on restore and check: off, warn or require")
+
 	flag.Parse()
 
+	// sub-commands (verify …) may be followed by more flags
+	var command []string
+	if flag.NArg() > 0 {
+		command = parseCommandLine(flag.Args())
+	}
+
 	// Отмечаем, задавал ли пользователь --ftp-keep-factor вручную
 	flag.Visit(func(f *flag.Flag) {
 		if f.Name == "ftp-keep-factor" {
@@ -112,6 +198,12 @@ func main() {
 		ftpKeepFactor = 4
 	}
 
+	switch sigPolicy {
+	case sigPolicyOff, sigPolicyWarn, sigPolicyRequire:
+	default:
+		log.Fatalf("%s--sig-policy must be off, warn or require%s", red, reset)
+	}
+
 	// Prepare exclusion map
 	excludePorts = make(map[string]struct{})
 	if excludePortsCSV != "" {
@@ -120,6 +212,10 @@ func main() {
 		}
 	}
 
+	if len(command) > 0 {
+		os.Exit(runCommand(command))
+	}
+
 	// Check if we are running in check mode first
 	if checkHours > 0 {
 		runCheckMode()
@@ -130,6 +226,14 @@ func main() {
 	switch {
 	case *helpFlag:
 		printHelp()
+	case *genKeyFlag:
+		if err := generateSigningKey(signKeyFile); err != nil {
+			suggestSudo(err)
+			log.Fatalf("%sCannot create signing key: %v%s", red, err, reset)
+		}
+	case *listFlag && fromFTP:
+		loadFTPAccounts()
+		listRemoteBackups()
 	case *listFlag:
 		listBackups()
 	case *restoreFlag:
@@ -146,6 +250,7 @@ func main() {
 		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
 		go func() { <-sig; releaseLock(); os.Exit(1) }()
 
+		cleanupPartialFiles()
 		initFTP()
 		runBackup()
 	}
@@ -158,7 +263,30 @@ func printHelp() {
 
 	fmt.Printf("%s🚀 Smart & Friendly Redis Backup Tool%s\n", cyan, reset)
 	fmt.Printf("%sBuilt by CHICHA — good dog, great backups. 🐕💾%s\n\n", cyan, reset)
-	fmt.Printf("%sUSAGE%s\n  %s [flags]\n\n", cyan, reset, exe)
+	fmt.Printf("%sUSAGE%s\n  %s [flags]\n  %s <command> [flags] <args>\n\n", cyan, reset, exe, exe)
+
+	fmt.Printf("%sCOMMANDS%s\n", cyan, reset)
+	fmt.Println("  verify [archive|dir …]    Parse archived RDBs (magic, version, opcodes, CRC64); default: whole backup tree")
+	fmt.Println("  diff <old> <new>          Keys added/removed/changed between two archives")
+	fmt.Println("                            (--port P alone: two newest daily archives; --format summary|detailed)")
+	fmt.Println("  export <archive>          Dump keys as JSON Lines or, with --format resp, for redis-cli --pipe")
+	fmt.Println("                            (--db N, --match 'user:*'; --port P alone: newest daily archive)")
+	fmt.Println("  restore-keys [archive]    RESTORE keys matching --match into the running Redis --port")
+	fmt.Println("                            (--on-conflict replace|skip|rename, --rename-prefix, --dry-run)")
+	fmt.Println("  test-restore [archive …]  Load archives into a sandbox redis-server and compare key counts")
+	fmt.Println("                            (default: newest daily archive of every instance, or of --port)")
+	fmt.Println("  report [archive]          Biggest keys, prefixes, collection sizes, TTL spread")
+	fmt.Println("                            (--top N, --delimiter ':', --format table|csv|json; --port P: newest daily)")
+	fmt.Println("  archive-aof               Copy new Redis 7 AOF files to redis_<port>/aof (run from cron; --port P: one instance)")
+	fmt.Println("  pitr                      Rebuild --port as of --at from the archived AOF in a sandbox,")
+	fmt.Println("                            then write --output <file.rdb> and/or copy keys into --target-port")
+	fmt.Println("  restore [archive] --yes   Non-interactive restore: archive name, or --port P with --latest | --at <time>")
+	fmt.Println("                            (--at: newest snapshot at or before <time> by .meta, local and FTP replicas)")
+	fmt.Println("                            (--tier daily|weekly|monthly|yearly, --target-port P, --format json)")
+	fmt.Println("                            exit 2 = bad arguments, 3 = refused by a check, 4 = failed while restoring")
+	fmt.Println("                            --dry-run: print the restore plan (files, owner, RDB version, key/size diff) only")
+	fmt.Println("  rollback [id] --yes       Put back the RDB a restore replaced (journal id, or --port P: its last restore);")
+	fmt.Println("                            without arguments the restore journal is printed")
 
 	fmt.Printf("%sGENERAL FLAGS%s\n", cyan, reset)
 	fmt.Println("  --list                    List existing backups and exit")
@@ -171,6 +299,12 @@ func printHelp() {
 	fmt.Printf("%sBACKUP CONTROL and MONITORING%s\n", cyan, reset)
 	fmt.Println("  --exclude-ports <csv>     Comma‑separated list of Redis ports NOT to back up")
 	fmt.Println("  --check <hours>           Verify freshness/size; CRITICAL if older than <hours>")
+	fmt.Println("  --check-rdb               With --check: also parse the newest archived RDB per instance")
+	fmt.Println("  --skip-unchanged          Record 'unchanged' instead of a new archive when the RDB is identical")
+	fmt.Println("  --volume-size <MB>        Split archives into numbered volumes of <MB> each (0 = single file)")
+	fmt.Println("  --check-restore-test <d>  With --check: WARNING if no archive was test-restored within <d> days")
+	fmt.Println("  --redis-server <bin>      redis-server for test-restore sandboxes (default: from PATH)")
+	fmt.Println("  --load-timeout <sec>      Max seconds for Redis to load a restored dump (default: 600)")
 
 	fmt.Printf("%sFTP OFF‑SITE%s\n", cyan, reset)
 	fmt.Println("  --ftp-conf <file>         Credentials file (default: /etc/ftp-backup.conf)")
@@ -178,6 +312,22 @@ func printHelp() {
 	fmt.Println("  --ftp-user <user>         FTP username")
 	fmt.Println("  --ftp-pass <pass>         FTP password")
 	fmt.Println("  --ftp-keep-factor <n>     Store data on FTP n× longer than locally (default: 4)")
+	fmt.Println("  --from-ftp                --list / --restore / restore: use the archives on the FTP accounts")
+
+	fmt.Printf("%sSIGNING%s\n", cyan, reset)
+	fmt.Println("  --gen-sign-key            Create an Ed25519 key pair at --sign-key and exit")
+	fmt.Println("  --sign-key <file>         Private key; archives are signed if it exists (default: /etc/redis-backup/sign.key)")
+	fmt.Println("  --verify-key <file>       Public key for restore/check (default: <sign-key>.pub)")
+	fmt.Println("  --sig-policy <p>          off | warn | require – missing/invalid signatures (default: warn)")
+
+	fmt.Printf("%sRESTORE%s\n", cyan, reset)
+	fmt.Println("  --force-version           Restore even if the target Redis is older than the archived RDB format")
+	fmt.Println("  --source-host <host>      --list / --restore / restore / pitr / archive commands: use the backups of another host")
+	fmt.Println("  --stop-cmd <cmd>          Stop a running target before the swap, e.g. 'systemctl stop redis-server@{port}'")
+	fmt.Println("                            (default: SHUTDOWN NOSAVE)")
+	fmt.Println("  --start-cmd <cmd>         Start it again afterwards (default: relaunch redis-server with its config file)")
+	fmt.Println("  --keep-snapshots <n>      Pre-restore snapshots (<rdb>.pre-restore-<time>) kept per RDB (default: 3, 0 = all)")
+	fmt.Println("  --archive-snapshot        Also archive each pre-restore snapshot into redis_<port>/pre-restore")
 
 	fmt.Printf("%sEXAMPLES%s\n", cyan, reset)
 	fmt.Printf("  # Basic backup\n  sudo %s\n\n", exe)
@@ -217,8 +367,10 @@ func suggestSudo(err error) {
 
 /******************** LIST ********************/
 func listBackups() {
-	host, _ := os.Hostname()
-	root := filepath.Join(backupPath, host, backupSubdir) // ← добавили backupSubdir
+	root := sourceBackupRoot()
+	if sourceHost != "" {
+		fmt.Printf("%s🖥  Backups of host %s%s\n", cyan, sourceHost, reset)
+	}
 
 	entries, err := os.ReadDir(root)
 	if err != nil {
@@ -228,33 +380,101 @@ func listBackups() {
 
 	for _, e := range entries {
 		if e.IsDir() && strings.HasPrefix(e.Name(), "redis_") {
-			daily := filepath.Join(root, e.Name(), "daily")
 			fmt.Printf("%s📂 %s%s\n", cyan, e.Name(), reset)
-			files, _ := os.ReadDir(daily)
-			for _, f := range files {
-				fmt.Printf("  • %s\n", f.Name())
+			var prev *keyspaceSummary
+			for _, a := range instanceArchives(filepath.Join(root, e.Name()), nil) {
+				name := filepath.Base(a.Path)
+				if a.Marker {
+					if m, err := readUnchangedMarker(a.Path); err == nil {
+						fmt.Printf("  • %-9s %s (unchanged, see %s)\n", a.Tier, name, m.SameAs)
+						continue
+					}
+				}
+				if idx, err := readVolumeIndex(a.Path + volumeIndexSuffix); err == nil {
+					name = fmt.Sprintf("%s (%d volumes)", name, len(idx.Parts))
+				}
+				var summary string
+				summary, prev = describeArchive(a.Path, prev)
+				if summary != "" {
+					fmt.Printf("  • %-9s %s — %s\n", a.Tier, name, summary)
+				} else {
+					fmt.Printf("  • %-9s %s\n", a.Tier, name)
+				}
 			}
 		}
 	}
 }
 
 /**************** INTERACTIVE RESTORE *********/
+
+// chooseSourceHost asks whose backups to restore when there are backups of
+// other hosts (e.g. of the server this one replaces). Enter keeps this host.
+func chooseSourceHost(reader *bufio.Reader, hosts []string) bool {
+	local, _ := os.Hostname()
+	if len(hosts) == 0 || (len(hosts) == 1 && hosts[0] == local) {
+		return true
+	}
+	fmt.Println("Select host whose backups to restore:")
+	def := 0
+	for i, h := range hosts {
+		mark := ""
+		if h == local {
+			mark, def = " (this host)", i+1
+		}
+		fmt.Printf("  [%d] %s%s\n", i+1, h, mark)
+	}
+	if def > 0 {
+		fmt.Printf(">>> [%d] ", def)
+	} else {
+		fmt.Print(">>> ")
+	}
+	line, _ := reader.ReadString('\n')
+	idx := def
+	if s := strings.TrimSpace(line); s != "" {
+		idx, _ = strconv.Atoi(s)
+	}
+	if idx < 1 || idx > len(hosts) {
+		fmt.Println("Invalid choice")
+		return false
+	}
+	sourceHost = hosts[idx-1]
+	return true
+}
 func interactiveRestore() {
-	host, _ := os.Hostname()
-	root := filepath.Join(backupPath, host, backupSubdir) // ← добавили backupSubdir
 	reader := bufio.NewReader(os.Stdin)
 
-	dirs, err := os.ReadDir(root)
-	if err != nil {
-		suggestSudo(err)
-		fmt.Printf("%sCannot open %s: %v%s\n", red, root, err, reset)
-		return
+	if fromFTP {
+		loadFTPAccounts()
+		if !ftpEnabled {
+			fmt.Printf("%sNo FTP accounts configured (%s or --ftp-host)%s\n", red, ftpConfFile, reset)
+			return
+		}
+	}
+	if sourceHost == "" {
+		hosts := backupHosts()
+		if fromFTP {
+			hosts = remoteHosts()
+		}
+		if !chooseSourceHost(reader, hosts) {
+			return
+		}
 	}
+	root := sourceBackupRoot()
 
 	var ports []string
-	for _, d := range dirs {
-		if d.IsDir() && strings.HasPrefix(d.Name(), "redis_") {
-			ports = append(ports, strings.TrimPrefix(d.Name(), "redis_"))
+	if fromFTP {
+		ports = remotePorts()
+	} else {
+		dirs, err := os.ReadDir(root)
+		if err != nil {
+			suggestSudo(err)
+			fmt.Printf("%sCannot open %s: %v%s\n", red, root, err, reset)
+			return
+		}
+		for _, d := range dirs {
+			if d.IsDir() && strings.HasPrefix(d.Name(), "redis_") {
+				ports = append(ports, strings.TrimPrefix(d.Name(), "redis_"))
+			}
 		}
 	}
 	if len(ports) == 0 {
@@ -275,41 +495,137 @@ func interactiveRestore() {
 	}
 	port := ports[idx-1]
 
-	dailyDir := filepath.Join(root, "redis_"+port, "daily") // ← путь через backupSubdir
-	files, err := os.ReadDir(dailyDir)
-	if err != nil {
-		suggestSudo(err)
-		fmt.Printf("%sCannot read %s: %v%s\n", red, dailyDir, err, reset)
-		return
+	var archives []tieredArchive
+	var remote []remoteArchive
+	if fromFTP {
+		remote = listRemoteArchives(port, nil)
+		for _, r := range remote {
+			archives = append(archives, tieredArchive{Path: r.Name, Tier: r.Tier, Time: r.Time, Marker: r.Marker})
+		}
+	} else {
+		archives = instanceArchives(filepath.Join(root, "redis_"+port), nil)
 	}
-	if len(files) == 0 {
+	if len(archives) == 0 {
 		fmt.Printf("%sNo archives for port %s%s\n", red, port, reset)
 		return
 	}
 
 	fmt.Println("Select archive:")
-	for i, f := range files {
-		fmt.Printf("  [%d] %s\n", i+1, f.Name())
+	var prev *keyspaceSummary
+	for i, a := range archives {
+		var summary string
+		if remote != nil {
+			summary = fmt.Sprintf("%.1f MB @ %s", humanMB(remote[i].Size), remote[i].Account.Host)
+		} else {
+			summary, prev = describeArchive(a.Path, prev)
+		}
+		if summary != "" {
+			fmt.Printf("  [%d] %-9s %s — %s\n", i+1, a.Tier, filepath.Base(a.Path), summary)
+		} else {
+			fmt.Printf("  [%d] %-9s %s\n", i+1, a.Tier, filepath.Base(a.Path))
+		}
 	}
-	fmt.Print(">>> ")
+	fmt.Print("Number, or a time like \"2025-01-07 18:00\" for the last snapshot before it\n>>> ")
 	line, _ = reader.ReadString('\n')
-	idx, _ = strconv.Atoi(strings.TrimSpace(line))
-	if idx < 1 || idx > len(files) {
+	line = strings.TrimSpace(line)
+	idx, err := strconv.Atoi(line)
+	if err != nil {
+		at, err := parseTimeArg(line)
+		if err != nil {
+			fmt.Println("Invalid choice")
+			return
+		}
+		bounds := make([]time.Time, len(archives))
+		snapshot := func(i int) time.Time { return bounds[i] }
+		if remote != nil {
+			rs := newRemoteSnapshots()
+			defer rs.close()
+			for i, r := range remote {
+				bounds[i] = r.Time
+			}
+			snapshot = func(i int) time.Time { return rs.time(remote[i]) }
+		} else {
+			for i, a := range archives {
+				bounds[i] = localSnapshotTime(a)
+			}
+		}
+		var snap time.Time
+		if idx, snap = pickArchive(bounds, at, snapshot); idx < 0 {
+			fmt.Printf("%sNo snapshot at or before %s%s\n", red, at.Format("2006-01-02 15:04:05"), reset)
+			return
+		}
+		idx++
+		fmt.Printf("%s🎯 %s/%s, snapshot %s%s\n", cyan, archives[idx-1].Tier, filepath.Base(archives[idx-1].Path), snap.Format("2006-01-02 15:04:05"), reset)
+	}
+	if idx < 1 || idx > len(archives) {
 		fmt.Println("Invalid choice")
 		return
 	}
-	archive := files[idx-1].Name()
+	archivePath := archives[idx-1].Path
+	archive := filepath.Join(archives[idx-1].Tier, filepath.Base(archivePath))
+
+	// the archive may go into another instance (e.g. a spare one to look at old data)
+	running := detectRedisPorts()
+	if len(running) > 0 {
+		fmt.Printf("Running instances: %s\n", strings.Join(running, ", "))
+	}
+	fmt.Printf("Restore into Redis port [%s]: ", port)
+	line, _ = reader.ReadString('\n')
+	target := strings.TrimSpace(line)
+	if target == "" {
+		target = port
+	}
+	if _, err := strconv.Atoi(target); err != nil {
+		fmt.Println("Invalid port")
+		return
+	}
+
+	tmpDir := ""
+	if remote != nil {
+		local, dir, _, err := fetchRemoteArchive(sameRemoteArchive(remote, remote[idx-1]))
+		if err != nil {
+			log.Fatalf("%s%v%s", red, err, reset)
+		}
+		archivePath, tmpDir = local, dir
+	}
+	exit := func(code int) {
+		if tmpDir != "" {
+			os.RemoveAll(tmpDir) // deferred calls do not run on os.Exit
+		}
+		os.Exit(code)
+	}
+
+	plan, err := planRestore(archivePath, target)
+	if plan != nil {
+		printPlan(plan)
+	}
+	if err != nil {
+		fmt.Printf("%s%v%s\n", red, err, reset)
+		exit(restoreExitCode(err))
+	}
+	if dryRun {
+		exit(0)
+	}
 
-	fmt.Printf("%s⚠  Redis %s will be restored from %s. Continue? (y/N): %s",
-		yellow, port, archive, reset)
+	if target != port {
+		fmt.Printf("%s⚠  Redis %s will be overwritten with %s (backup of %s). Continue? (y/N): %s",
+			yellow, target, archive, port, reset)
+	} else {
+		fmt.Printf("%s⚠  Redis %s will be restored from %s. Continue? (y/N): %s",
+			yellow, port, archive, reset)
+	}
 	confirm, _ := reader.ReadString('\n')
 	confirm = strings.ToLower(strings.TrimSpace(confirm))
 	if confirm != "y" && confirm != "yes" {
 		fmt.Println("Cancelled.")
-		return
+		exit(0)
 	}
 
-	restoreBackup(port, archive) // restoreBackup тоже обновлён, см. ниже
+	if _, err := plan.execute(); err != nil {
+		fmt.Printf("%s%v%s\n", red, err, reset)
+		exit(restoreExitCode(err))
+	}
+	exit(0)
 }
 
 /******************* BACKUP LOOP *******************/
@@ -394,20 +710,16 @@ func detectRedisPorts() []string {
 }
 
 func getRedisDir(port string) string {
-	out, err := exec.Command("redis-cli", "-p", port, "CONFIG", "GET", "dir").Output()
-	if err != nil {
-		suggestSudo(err)
-		return ""
-	}
-	parts := strings.Split(strings.TrimSpace(string(out)), "\n")
-	if len(parts) >= 2 {
-		return strings.TrimSpace(parts[1])
-	}
-	return ""
+	return getRedisConfig(port, "dir")
 }
 
 func getRedisRDB(port string) string {
-	out, err := exec.Command("redis-cli", "-p", port, "CONFIG", "GET", "dbfilename").Output()
+	return getRedisConfig(port, "dbfilename")
+}
+
+// getRedisConfig returns one CONFIG GET value ("" if unknown).
+func getRedisConfig(port, key string) string {
+	out, err := exec.Command("redis-cli", "-p", port, "CONFIG", "GET", key).Output()
 	if err != nil {
 		suggestSudo(err)
 		return ""
@@ -440,105 +752,222 @@ func backupInstance(port, rdbPath, host string, now time.Time) string {
 	ts := now.Format("2006-01-02_15-04-05")
 	archive := filepath.Join(daily, fmt.Sprintf("%s_%s.tar.gz", ts, inst))
 
+	checksum, err := fileSHA256(rdbPath)
+	if err != nil {
+		log.Printf("%sCannot checksum %s: %v%s", yellow, rdbPath, err, reset)
+	}
+
+	if skipUnchanged && checksum != "" {
+		if prev, _ := findLatestArchive(daily); prev != "" {
+			if meta, err := readBackupMeta(prev); err == nil && meta.RDBSHA256 == checksum {
+				marker := filepath.Join(daily, fmt.Sprintf("%s_%s%s", ts, inst, unchangedSuffix))
+				if err := writeUnchangedMarker(marker, prev, rdbPath, checksum); err != nil {
+					suggestSudo(err)
+					log.Printf("%sCannot record unchanged entry %s: %v%s", red, marker, err, reset)
+					return ""
+				}
+				log.Printf("%s♻ RDB unchanged – recorded %s (see %s)%s",
+					green, filepath.Base(marker), filepath.Base(prev), reset)
+				copyToTiers(prev, now, weekly, monthly, yearly)
+				applyRetention(daily)
+				return marker
+			}
+		}
+	}
+
 	log.Printf("%s📦 Archiving %s …%s", cyan, archive, reset)
 	if err := createTarGz(archive, []string{rdbPath}); err != nil {
 		suggestSudo(err)
 		log.Printf("%sArchive error: %v%s", red, err, reset)
 		return ""
 	}
-	if err := writeBackupMeta(archive, rdbPath); err != nil {
+	if err := writeBackupMeta(archive, rdbPath, checksum); err != nil {
 		// We still keep the backup, but note that verification may be weaker without metadata.
 		log.Printf("%sFailed to store backup metadata for %s: %v%s", yellow, archive, err, reset)
 	}
 	printFileSize(archive)
+	if isSplitArchive(archive) {
+		log.Printf("%s✂ Split into %d volumes%s", green, len(archiveFiles(archive))-1, reset)
+	}
+	if summary, err := storeKeyspaceSummary(archive); err != nil {
+		log.Printf("%sCannot summarize archived RDB %s: %v%s", red, filepath.Base(archive), err, reset)
+	} else {
+		log.Printf("%s🔑 %s%s", green, summary, reset)
+	}
+	if err := signArchive(archive, host, port); err != nil {
+		log.Printf("%sCannot sign %s: %v%s", red, archive, err, reset)
+	}
+
+	copyToTiers(archive, now, weekly, monthly, yearly)
+	applyRetention(daily)
 
+	return archive
+}
+
+// copyToTiers puts the long-term copies of archive in place on the days they are due.
+// The copies share data with the daily archive whenever the filesystem allows it.
+func copyToTiers(archive string, now time.Time, weekly, monthly, yearly string) {
+	copyOnce := func(dir string) {
+		dst := filepath.Join(dir, filepath.Base(archive))
+		if archiveExists(dst) {
+			return // an unchanged snapshot may point at an archive that is already there
+		}
+		// index comes last in archiveFiles, so a half-copied split archive stays invisible
+		for _, f := range archiveFiles(archive) {
+			if err := linkOrCopy(f, filepath.Join(dir, filepath.Base(f))); err != nil {
+				log.Printf("%sCannot copy %s to %s: %v%s", red, filepath.Base(f), dir, err, reset)
+				return
+			}
+		}
+		for _, sidecar := range []string{".meta", signatureSuffix} {
+			if _, err := os.Stat(archive + sidecar); err == nil {
+				if err := linkOrCopy(archive+sidecar, dst+sidecar); err != nil {
+					log.Printf("%sCannot copy %s to %s: %v%s", red, filepath.Base(archive+sidecar), dir, err, reset)
+				}
+			}
+		}
+	}
 	if now.Weekday() == time.Sunday {
-		copyFile(archive, filepath.Join(weekly, filepath.Base(archive)))
+		copyOnce(weekly)
 	}
 	if now.Day() == 1 {
-		copyFile(archive, filepath.Join(monthly, filepath.Base(archive)))
+		copyOnce(monthly)
 	}
 	if now.YearDay() == 1 {
-		copyFile(archive, filepath.Join(yearly, filepath.Base(archive)))
+		copyOnce(yearly)
 	}
+}
 
+func applyRetention(daily string) {
 	if maxCopies > 0 {
 		rotateCopies(daily, maxCopies)
 	} else {
 		cleanupOldFiles(daily, keepDays)
 	}
-
-	return archive
 }
 
 /********************** RESTORE ************************/
-func restoreBackup(port, archiveName string) {
-	host, _ := os.Hostname()
-	inst := "redis_" + port
-	archivePath := filepath.Join(backupPath, host, backupSubdir, // ← добавили backupSubdir
-		inst, "daily", archiveName)
+// restoreBackup puts an archive in place of the RDB of instance <target>.
+// Location, file name and ownership are taken from the target. Errors
+// carry the exit code of the restore command (see restoreError).
+func restoreBackup(archivePath, target string) (*restoreResult, error) {
+	p, err := planRestore(archivePath, target)
+	if err != nil {
+		return nil, err
+	}
+	return p.execute()
+}
 
-	if _, err := os.Stat(archivePath); err != nil {
-		suggestSudo(err)
-		log.Fatalf("%sArchive %s not found%s", red, archivePath, reset)
+// execute carries out a plan made by planRestore.
+func (p *restorePlan) execute() (*restoreResult, error) {
+	if err := tryLock(); err != nil {
+		return nil, restoreFailf(exitRestoreRefused, "%v", err)
+	}
+	defer releaseLock()
+
+	res, err := p.apply()
+	if err == nil && res.PreviousFile != "" {
+		if archiveSnapshots {
+			if res.SnapshotArchive, err = archiveSnapshot(res.PreviousFile, p.TargetPort); err != nil {
+				suggestSudo(err)
+				p.warn(fmt.Sprintf("cannot archive the pre-restore snapshot: %v", err))
+				res.Warnings, err = p.Warnings, nil
+			} else {
+				log.Printf("%s📦 Pre-restore snapshot archived to %s%s", green, res.SnapshotArchive, reset)
+			}
+		}
+		pruneSnapshots(p.RDBFile, snapshotDir(p.TargetPort))
 	}
+	p.record(res, err)
+	return res, err
+}
 
-	restoreDir := getRedisDir(port)
-	fileName := getRedisRDB(port)
-	if restoreDir == "" || fileName == "" {
-		log.Fatalf("%sCannot determine Redis directory for port %s%s", red, port, reset)
+// apply carries out the plan.
+func (p *restorePlan) apply() (*restoreResult, error) {
+	res := &restoreResult{
+		SourcePort: p.SourcePort, TargetPort: p.TargetPort, Archive: p.Archive, Tier: p.Tier,
+		SnapshotTime: p.SnapshotTime, RDBFile: p.RDBFile, Warnings: p.Warnings,
+	}
+	if p.expected != nil {
+		res.Keys = p.expected.Keys
 	}
+	currentFile, launcher := p.RDBFile, p.launcher
 
-	currentFile := filepath.Join(restoreDir, fileName)
+	if launcher != nil {
+		// the snapshot should hold what Redis has in memory, not its last save
+		log.Printf("%s💾 Saving Redis %s before the restore%s", cyan, p.TargetPort, reset)
+		if err := saveRedis(p.TargetPort); err != nil {
+			return nil, restoreFailf(exitRestoreRefused, "cannot save Redis %s before the restore: %v", p.TargetPort, err)
+		}
+		log.Printf("%s⏹  Stopping Redis %s%s", yellow, p.TargetPort, reset)
+		if err := stopRedis(p.TargetPort); err != nil {
+			return nil, restoreFailf(exitRestoreFailed, "cannot stop Redis %s: %v", p.TargetPort, err)
+		}
+	}
 
 	// --- сохраняем старый RDB (если был) ---
-	var origUID, origGID int
-	var origMode os.FileMode
-
-	if info, err := os.Stat(currentFile); err == nil {
-		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
-			origUID = int(stat.Uid)
-			origGID = int(stat.Gid)
-		}
-		origMode = info.Mode()
-		backupName := currentFile + ".backup"
-		log.Printf("%s🔁 Renaming current RDB → %s%s", yellow, backupName, reset)
-		if err := os.Rename(currentFile, backupName); err != nil {
+	if _, err := os.Stat(currentFile); p.RenameTo != "" && err == nil {
+		kept, err := keepSnapshot(currentFile, p.RenameTo)
+		if err != nil {
 			suggestSudo(err)
-			log.Fatalf("%sCannot rename current file: %v%s", red, err, reset)
+			return nil, restoreFailed(launcher, "", "", "cannot rename current file: %v", err)
 		}
+		log.Printf("%s🔁 Renamed current RDB → %s%s", yellow, kept, reset)
+		res.PreviousFile = kept
 	}
 
-	log.Printf("%s🔄 Extracting %s → %s%s", cyan, archiveName, restoreDir, reset)
-	if err := extractTarGz(archivePath, restoreDir); err != nil {
+	var err error
+	if p.rawRDB {
+		log.Printf("%s🔄 Copying %s → %s%s", cyan, filepath.Base(p.archivePath), currentFile, reset)
+		err = copyRDB(p.archivePath, currentFile)
+	} else {
+		log.Printf("%s🔄 Extracting %s → %s%s", cyan, filepath.Base(p.archivePath), currentFile, reset)
+		err = extractRDB(p.archivePath, currentFile)
+	}
+	if err != nil {
 		suggestSudo(err)
-		log.Fatalf("%sRestore error: %v%s", red, err, reset)
+		return nil, restoreFailed(launcher, currentFile, res.PreviousFile, "restore error: %v", err)
 	}
 
-	newFile := filepath.Join(restoreDir, fileName)
-	if origMode != 0 {
-		_ = os.Chmod(newFile, origMode)
+	_ = os.Chmod(currentFile, p.mode)
+	if p.UID >= 0 && os.Geteuid() == 0 {
+		if err := os.Chown(currentFile, p.UID, p.GID); err != nil {
+			p.warn(fmt.Sprintf("cannot give %s to %d:%d: %v", currentFile, p.UID, p.GID, err))
+			res.Warnings = p.Warnings
+		}
 	}
-	if origUID != 0 || origGID != 0 {
-		_ = os.Chown(newFile, origUID, origGID)
+
+	if launcher != nil {
+		keys, err := launcher.startAndVerify(p.expected)
+		if err != nil {
+			return nil, restoreFailed(launcher, currentFile, res.PreviousFile, "restored Redis %s failed verification: %v", p.TargetPort, err)
+		}
+		res.Keys = keys
+		log.Printf("%s✔ Redis %s is up with %d keys%s", green, p.TargetPort, keys, reset)
+	} else {
+		log.Printf("%sRedis %s is not running; it loads the restored RDB when started%s", cyan, p.TargetPort, reset)
 	}
 
 	log.Printf("%s✔ Restore complete%s", green, reset)
+	return res, nil
 }
 
-/********************** FTP ***************************/
-func initFTP() {
-	// 1) читаем конфиг-файл, если есть
-	if _, err := os.Stat(ftpConfFile); err == nil {
-		_ = parseFTPConf(ftpConfFile)
+// restoreFailed rolls a managed restore back (when the target was stopped
+// for it) and builds the error to return.
+func restoreFailed(l *redisLauncher, currentFile, previousFile, format string, args ...interface{}) error {
+	err := restoreFailf(exitRestoreFailed, format, args...)
+	if l == nil {
+		return err
 	}
-
-	// 2) если заданы флаги host/user/pass – считаем их высшим приоритетом
-	if ftpHost != "" {
-		ftpAccounts = []ftpAccount{{Host: ftpHost, User: ftpUser, Pass: ftpPass}}
+	if rbErr := l.rollback(currentFile, previousFile); rbErr != nil {
+		return restoreFailf(exitRestoreFailed, "%v; rollback failed too: %v", err, rbErr)
 	}
+	return restoreFailf(exitRestoreFailed, "%v; previous RDB is back in place", err)
+}
 
-	ftpEnabled = len(ftpAccounts) > 0
+/********************** FTP ***************************/
+func initFTP() {
+	loadFTPAccounts()
 	if !ftpEnabled {
 		return
 	}
@@ -550,6 +979,27 @@ func initFTP() {
 	}
 }
 
+// loadFTPAccounts reads the accounts from the conf file and the --ftp-* flags.
+func loadFTPAccounts() {
+	// 1) читаем конфиг-файл, если есть
+	if _, err := os.Stat(ftpConfFile); err == nil {
+		_ = parseFTPConf(ftpConfFile)
+	}
+
+	// 2) если заданы флаги host/user/pass – считаем их высшим приоритетом
+	if ftpHost != "" {
+		acc := ftpAccount{Host: ftpHost, User: ftpUser, Pass: ftpPass}
+		for _, a := range ftpAccounts {
+			if a.Host == ftpHost && acc.User == "" {
+				acc = a // --ftp-host alone picks an account from the conf file
+			}
+		}
+		ftpAccounts = []ftpAccount{acc}
+	}
+
+	ftpEnabled = len(ftpAccounts) > 0
+}
+
 func parseFTPConf(path string) error {
 	f, err := os.Open(path)
 	if err != nil {
@@ -616,18 +1066,23 @@ func uploadToSingleFTP(acc ftpAccount, localPath, remoteRel string) {
 		_ = c.MakeDir(cwd)
 	}
 
-	f, err := os.Open(localPath)
-	if err != nil {
-		log.Printf("%sFTP open local: %v%s", red, err, reset)
-		return
-	}
-	defer f.Close()
-
+	// volumes and sidecars first, the archive (or its index) last – the remote
+	// archive appears only when complete
 	remotePath := filepath.ToSlash(remoteRel)
-	log.Printf("%s⇪ Uploading to %s: %s%s", cyan, acc.Host, remotePath, reset)
-	if err := c.Stor(remotePath, f); err != nil {
-		log.Printf("%sFTP upload %s: %v%s", red, acc.Host, err, reset)
-		return
+	files := archiveFiles(localPath)
+	last := files[len(files)-1]
+	files = files[:len(files)-1]
+	for _, sidecar := range []string{".meta", signatureSuffix} {
+		if _, err := os.Stat(localPath + sidecar); err == nil {
+			files = append(files, localPath+sidecar)
+		}
+	}
+	files = append(files, last)
+	for _, local := range files {
+		remoteFile := filepath.ToSlash(filepath.Join(filepath.Dir(remoteRel), filepath.Base(local)))
+		if err := storFTP(c, acc, local, remoteFile); err != nil {
+			return
+		}
 	}
 
 	// ротация
@@ -641,6 +1096,29 @@ func uploadToSingleFTP(acc ftpAccount, localPath, remoteRel string) {
 	}
 }
 
+// storFTP uploads one file under a temporary name and renames it into place.
+func storFTP(c *ftp.ServerConn, acc ftpAccount, localPath, remotePath string) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		log.Printf("%sFTP open local: %v%s", red, err, reset)
+		return err
+	}
+	defer f.Close()
+
+	log.Printf("%s⇪ Uploading to %s: %s%s", cyan, acc.Host, remotePath, reset)
+	// an interrupted transfer must not look like a finished archive on the server
+	if err := c.Stor(remotePath+partialSuffix, f); err != nil {
+		log.Printf("%sFTP upload %s: %v%s", red, acc.Host, err, reset)
+		_ = c.Delete(remotePath + partialSuffix)
+		return err
+	}
+	if err := c.Rename(remotePath+partialSuffix, remotePath); err != nil {
+		log.Printf("%sFTP rename %s: %v%s", red, acc.Host, err, reset)
+		return err
+	}
+	return nil
+}
+
 func uploadToFTP(localPath, remoteRel string) {
 	if !ftpEnabled {
 		return
@@ -656,15 +1134,39 @@ func cleanupOldFilesFTP(c *ftp.ServerConn, dir string, days int) {
 		return
 	}
 	cutoff := time.Now().AddDate(0, 0, -days)
+	var backups []retentionEntry
+	var stray []string
+	drop := make(map[string]bool)
 	for _, e := range entries {
 		if e.Type != ftp.EntryTypeFile {
 			continue
 		}
-		if e.Time.Before(cutoff) {
-			remoteFile := filepath.ToSlash(filepath.Join(dir, e.Name))
-			log.Printf("🧹 (FTP) Deleting old archive %s", remoteFile)
-			_ = c.Delete(remoteFile)
+		re, ok := newRetentionEntry(e.Name, e.Time)
+		switch {
+		case ok:
+			backups = append(backups, re)
+			if e.Time.Before(cutoff) {
+				drop[re.Name] = true
+			}
+		case isVolumeName(e.Name), strings.HasSuffix(e.Name, signatureSuffix):
+			// removed together with its archive
+		case e.Time.Before(cutoff):
+			stray = append(stray, e.Name)
+		}
+	}
+	keepReferencedArchives(backups, drop)
+
+	for _, e := range backups {
+		if !drop[e.Name] {
+			continue
 		}
+		log.Printf("🧹 (FTP) Deleting old archive %s", filepath.ToSlash(filepath.Join(dir, e.Name)))
+		ftpRemoveArchive(c, dir, e.Name, entries)
+	}
+	for _, name := range stray {
+		remoteFile := filepath.ToSlash(filepath.Join(dir, name))
+		log.Printf("🧹 (FTP) Deleting old file %s", remoteFile)
+		_ = c.Delete(remoteFile)
 	}
 }
 
@@ -717,10 +1219,44 @@ func runCheckMode() {
 			severity = max(severity, 2)
 		}
 
-		if fi, err := os.Stat(latestFile); err == nil {
-			latestSetSize += fi.Size()
+		if size, err := archiveSize(latestFile); err == nil {
+			latestSetSize += size
 			latestFiles++
 		}
+		if err := checkVolumes(latestFile); err != nil {
+			problems = append(problems, fmt.Sprintf("Redis %s: %v", port, err))
+			severity = max(severity, 2)
+		}
+		if checkRDB {
+			if _, err := verifyArchiveRDB(latestFile); err != nil {
+				problems = append(problems, fmt.Sprintf("Redis %s: corrupt RDB in %s: %v",
+					port, filepath.Base(latestFile), err))
+				severity = max(severity, 2)
+			}
+		}
+		if checkTestDays > 0 {
+			name, test := latestRestoreTest(filepath.Join(backupPath, host, backupSubdir, inst))
+			switch {
+			case test == nil:
+				problems = append(problems, fmt.Sprintf("Redis %s: never test-restored", port))
+				severity = max(severity, 1)
+			case !test.OK:
+				problems = append(problems, fmt.Sprintf("Redis %s: test restore of %s failed: %s", port, name, test.Error))
+				severity = max(severity, 2)
+			case now.Sub(time.Unix(test.Time, 0)) > time.Duration(checkTestDays)*24*time.Hour:
+				problems = append(problems, fmt.Sprintf("Redis %s: last test restore %d days ago", port,
+					int(now.Sub(time.Unix(test.Time, 0)).Hours()/24)))
+				severity = max(severity, 1)
+			}
+		}
+		if problem, fatal := checkSignaturePolicy(latestFile); problem != "" {
+			problems = append(problems, fmt.Sprintf("Redis %s: %s", port, problem))
+			if fatal {
+				severity = max(severity, 2)
+			} else {
+				severity = max(severity, 1)
+			}
+		}
 
 		// усыхание архива
 		currentRDB := filepath.Join(getRedisDir(port), getRedisRDB(port))
@@ -798,12 +1334,18 @@ func runCheckMode() {
 					severity = max(severity, 2)
 				}
 
+				entries, _ := c.List(remoteDaily)
+				if err := ftpCheckVolumes(c, remoteDaily, filepath.Base(latestPath), entries); err != nil {
+					problems = append(problems,
+						fmt.Sprintf("FTP %s redis %s: %v", acc.Host, port, err))
+					severity = max(severity, 2)
+				}
+
 				// количество копий
 				if expectedFtpCopies > 0 {
-					entries, _ := c.List(remoteDaily)
 					var cnt int
 					for _, e := range entries {
-						if e.Type == ftp.EntryTypeFile && strings.HasSuffix(e.Name, ".tar.gz") {
+						if _, ok := archiveLogicalName(e.Name); ok && e.Type == ftp.EntryTypeFile {
 							cnt++
 						}
 					}
@@ -873,18 +1415,32 @@ func findLatestFTPArchive(c *ftp.ServerConn, dir string) (string, int64, time.Ti
 		return "", 0, time.Time{}
 	}
 	var newest string
-	var newestTime time.Time
+	var newestTime, markerTime time.Time
 	var newestSize int64
 	for _, e := range entries {
-		if e.Type != ftp.EntryTypeFile || !strings.HasSuffix(e.Name, ".tar.gz") {
+		if e.Type != ftp.EntryTypeFile {
+			continue
+		}
+		if strings.HasSuffix(e.Name, unchangedSuffix) {
+			if e.Time.After(markerTime) {
+				markerTime = e.Time
+			}
+			continue
+		}
+		name, ok := archiveLogicalName(e.Name)
+		if !ok {
 			continue
 		}
 		if e.Time.After(newestTime) {
 			newestTime = e.Time
-			newest = filepath.ToSlash(filepath.Join(dir, e.Name))
-			newestSize = int64(e.Size)
+			newest = filepath.ToSlash(filepath.Join(dir, name))
+			newestSize = ftpArchiveSize(name, entries)
 		}
 	}
+	// an "unchanged" entry newer than the archive still proves the instance was backed up
+	if newest != "" && markerTime.After(newestTime) {
+		newestTime = markerTime
+	}
 	return newest, newestSize, newestTime
 }
 
@@ -901,25 +1457,51 @@ func findLatestArchive(dir string) (string, time.Time) {
 		return "", time.Time{}
 	}
 	var newest string
-	var newestTime time.Time
+	var newestTime, markerTime time.Time
 	for _, f := range files {
-		if f.IsDir() || !strings.HasSuffix(f.Name(), ".tar.gz") {
+		if f.IsDir() {
 			continue
 		}
 		path := filepath.Join(dir, f.Name())
-		if info, err := os.Stat(path); err == nil {
-			if info.ModTime().After(newestTime) {
-				newestTime = info.ModTime()
-				newest = path
+		switch {
+		case strings.HasSuffix(f.Name(), unchangedSuffix):
+			if info, err := os.Stat(path); err == nil && info.ModTime().After(markerTime) {
+				markerTime = info.ModTime()
+			}
+		default:
+			name, ok := archiveLogicalName(f.Name())
+			if !ok {
+				continue
+			}
+			if info, err := os.Stat(path); err == nil {
+				if info.ModTime().After(newestTime) {
+					newestTime = info.ModTime()
+					newest = filepath.Join(dir, name)
+				}
 			}
 		}
 	}
+	// The newest marker always refers to the newest archive, so freshness comes from the marker
+	// while size checks keep looking at the real data.
+	if newest != "" && markerTime.After(newestTime) {
+		newestTime = markerTime
+	}
 	return newest, newestTime
 }
 
 type backupMeta struct {
-	OriginalSize int64 `json:"original_size"`
-	SnapshotTime int64 `json:"snapshot_time"`
+	OriginalSize int64              `json:"original_size"`
+	SnapshotTime int64              `json:"snapshot_time"`
+	RDBSHA256    string             `json:"rdb_sha256,omitempty"`
+	Keyspace     *keyspaceSummary   `json:"keyspace,omitempty"`
+	RestoreTest  *restoreTestResult `json:"restore_test,omitempty"`
+}
+
+// unchangedMarker is stored instead of an archive when the RDB matches the latest backup.
+type unchangedMarker struct {
+	SameAs       string `json:"same_as"`
+	SnapshotTime int64  `json:"snapshot_time"`
+	RDBSHA256    string `json:"rdb_sha256"`
 }
 
 func compareSizes(originalPath, archivePath string) (bool, error) {
@@ -939,7 +1521,7 @@ func compareSizes(originalPath, archivePath string) (bool, error) {
 }
 
 func archivedPayloadSize(archivePath string) (int64, error) {
-	f, err := os.Open(archivePath)
+	f, err := openArchive(archivePath)
 	if err != nil {
 		return 0, err
 	}
@@ -973,7 +1555,7 @@ func referenceRDBSize(originalPath, archivePath string) (int64, error) {
 	return info.Size(), nil
 }
 
-func writeBackupMeta(archivePath, originalPath string) error {
+func writeBackupMeta(archivePath, originalPath, checksum string) error {
 	info, err := os.Stat(originalPath)
 	if err != nil {
 		return err
@@ -982,15 +1564,19 @@ func writeBackupMeta(archivePath, originalPath string) error {
 	meta := backupMeta{
 		OriginalSize: info.Size(),
 		SnapshotTime: info.ModTime().Unix(),
+		RDBSHA256:    checksum,
 	}
+	return saveBackupMeta(archivePath, meta)
+}
 
+func saveBackupMeta(archivePath string, meta backupMeta) error {
 	data, err := json.Marshal(meta)
 	if err != nil {
 		return err
 	}
 
 	// A sidecar file keeps the snapshot facts so later checks compare like for like.
-	return os.WriteFile(archivePath+".meta", append(data, '\n'), 0644)
+	return writeFileAtomic(archivePath+".meta", append(data, '\n'), 0644)
 }
 
 func readBackupMeta(archivePath string) (backupMeta, error) {
@@ -1007,20 +1593,75 @@ func readBackupMeta(archivePath string) (backupMeta, error) {
 	return meta, nil
 }
 
+func writeUnchangedMarker(markerPath, archivePath, originalPath, checksum string) error {
+	info, err := os.Stat(originalPath)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(unchangedMarker{
+		SameAs:       filepath.Base(archivePath),
+		SnapshotTime: info.ModTime().Unix(),
+		RDBSHA256:    checksum,
+	})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(markerPath, append(data, '\n'), 0644)
+}
+
+func readUnchangedMarker(markerPath string) (unchangedMarker, error) {
+	data, err := os.ReadFile(markerPath)
+	if err != nil {
+		return unchangedMarker{}, err
+	}
+
+	var m unchangedMarker
+	if err := json.Unmarshal(data, &m); err != nil {
+		return unchangedMarker{}, err
+	}
+	if m.SameAs == "" {
+		return unchangedMarker{}, fmt.Errorf("%s: no archive reference", markerPath)
+	}
+	return m, nil
+}
+
 /********************** FILE OPS **********************/
+
+// createTarGz writes the archive under a temporary name and renames it into
+// place only after everything, including the directory entry, is on disk.
 func createTarGz(dst string, files []string) error {
-	out, err := os.Create(dst)
+	if volumeSizeMB > 0 {
+		return createTarGzVolumes(dst, files, int64(volumeSizeMB)*1024*1024)
+	}
+
+	tmp := dst + partialSuffix
+	out, err := os.Create(tmp)
 	if err != nil {
 		suggestSudo(err)
 		return err
 	}
+	defer os.Remove(tmp) // no-op once renamed
 	defer out.Close()
 
-	gw := gzip.NewWriter(out)
-	defer gw.Close()
+	if err := writeTarGz(out, files); err != nil {
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(dst))
+}
 
+func writeTarGz(out io.Writer, files []string) error {
+	gw := gzip.NewWriter(out)
 	tw := tar.NewWriter(gw)
-	defer tw.Close()
 
 	for _, file := range files {
 		info, err := os.Stat(file)
@@ -1047,85 +1688,273 @@ func createTarGz(dst string, files []string) error {
 		}
 		f.Close()
 	}
-	return nil
+	// explicit closes: the trailers are part of a complete archive
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
 }
 
-func extractTarGz(src, dest string) error {
-	f, err := os.Open(src)
+// copyFile copies src to dst via a temporary file, fsync and rename, so dst
+// is either the old file or a complete copy.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
 	if err != nil {
 		suggestSudo(err)
 		return err
 	}
-	defer f.Close()
-	gr, err := gzip.NewReader(f)
+	defer in.Close()
+	tmp := dst + partialSuffix
+	out, err := os.Create(tmp)
 	if err != nil {
+		suggestSudo(err)
 		return err
 	}
-	defer gr.Close()
-	tr := tar.NewReader(gr)
-	for {
-		hdr, err := tr.Next()
-		if err == io.EOF {
-			break
+	defer os.Remove(tmp)
+	defer out.Close()
+	if _, err := io.Copy(out, in); err != nil {
+		return fmt.Errorf("copy %s: %w", dst, err)
+	}
+	if err := out.Sync(); err != nil {
+		return fmt.Errorf("sync %s: %w", dst, err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("close %s: %w", dst, err)
+	}
+	_ = os.Chmod(tmp, 0644)
+	if err := os.Rename(tmp, dst); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(dst))
+}
+
+// linkOrCopy makes dst a hardlink of src. A reflink covers filesystems or
+// setups that refuse hardlinks; the full copy is the cross-device fallback.
+func linkOrCopy(src, dst string) error {
+	err := os.Link(src, dst)
+	if err == nil {
+		return nil
+	}
+	if rerr := reflinkFile(src, dst+partialSuffix); rerr == nil {
+		if err := os.Rename(dst+partialSuffix, dst); err == nil {
+			_ = syncDir(filepath.Dir(dst))
+			return nil
 		}
+		_ = os.Remove(dst + partialSuffix)
+	}
+	log.Printf("%sCannot link %s (%v) – copying%s", yellow, filepath.Base(dst), err, reset)
+	return copyFile(src, dst)
+}
+
+// writeFileAtomic is os.WriteFile via a temporary file, fsync and rename.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp := path + partialSuffix
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	defer f.Close()
+
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir persists directory entries (new names after rename).
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil && !errors.Is(err, syscall.EINVAL) {
+		return err // some filesystems cannot fsync directories – that is fine
+	}
+	return nil
+}
+
+// cleanupPartialFiles removes leftovers of runs that were killed mid-write.
+// Must be called with the lock held so a running backup is not disturbed.
+func cleanupPartialFiles() {
+	host, _ := os.Hostname()
+	root := filepath.Join(backupPath, host, backupSubdir)
+	remove := func(path string) {
+		log.Printf("%s🧹 Removing incomplete file %s%s", yellow, path, reset)
+		_ = os.Remove(path)
+	}
+	_ = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
-			return err
+			return nil
 		}
-		outPath := filepath.Join(dest, hdr.Name)
-		of, err := os.Create(outPath)
-		if err != nil {
-			suggestSudo(err)
-			return err
+		if d.IsDir() {
+			if d.Name() == aofDirName {
+				return filepath.SkipDir // archive-aof cleans up under its own lock
+			}
+			removeOrphanVolumes(path, remove)
+			return nil
 		}
-		if _, err := io.Copy(of, tr); err != nil {
-			of.Close()
-			return err
+		if strings.HasSuffix(d.Name(), partialSuffix) {
+			remove(path)
 		}
-		of.Close()
-		_ = os.Chmod(outPath, os.FileMode(hdr.Mode))
-		_ = os.Chown(outPath, hdr.Uid, hdr.Gid)
-	}
-	return nil
+		return nil
+	})
 }
 
-func copyFile(src, dst string) {
-	in, err := os.Open(src)
+// isBackupEntry reports whether name is a finished archive, volume index or unchanged marker.
+func isBackupEntry(name string) bool {
+	_, ok := archiveLogicalName(name)
+	return ok || strings.HasSuffix(name, unchangedSuffix)
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
 	if err != nil {
-		suggestSudo(err)
-		log.Printf("open %s: %v", src, err)
-		return
+		return "", err
 	}
-	defer in.Close()
-	out, err := os.Create(dst)
-	if err != nil {
-		suggestSudo(err)
-		log.Printf("create %s: %v", dst, err)
-		return
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
 	}
-	defer out.Close()
-	_, _ = io.Copy(out, in)
-	_ = os.Chmod(dst, 0644)
+	return hex.EncodeToString(h.Sum(nil)), nil
 }
 
 func printFileSize(path string) {
-	if info, err := os.Stat(path); err == nil {
-		size := float64(info.Size()) / (1024 * 1024)
+	if total, err := archiveSize(path); err == nil {
+		size := float64(total) / (1024 * 1024)
 		log.Printf("%s💾 Archive size: %.2f MB%s", green, size, reset)
 	}
 }
 
+// logRemoval explains that deleting a hardlinked archive frees no space yet.
+func logRemoval(what, path string) {
+	if info, err := os.Stat(path); err == nil {
+		if st, ok := info.Sys().(*syscall.Stat_t); ok && st.Nlink > 1 {
+			log.Printf("🧹 Deleting %s %s (data kept by %d other tier link(s))",
+				what, filepath.Base(path), st.Nlink-1)
+			return
+		}
+	}
+	log.Printf("🧹 Deleting %s %s", what, filepath.Base(path))
+}
+
 func cleanupOldFiles(dir string, days int) {
-	files, _ := filepath.Glob(filepath.Join(dir, "*.tar.gz"))
+	backups := localRetentionEntries(dir)
 	cutoff := time.Now().AddDate(0, 0, -days)
+	drop := make(map[string]bool)
+	for _, e := range backups {
+		if e.Time.Before(cutoff) {
+			drop[e.Name] = true
+		}
+	}
+	keepReferencedArchives(backups, drop)
+
+	for _, e := range backups {
+		if drop[e.Name] {
+			logRemoval("old archive", filepath.Join(dir, e.Name))
+			removeEntry(dir, e)
+		}
+	}
+}
+
+/*************** RETENTION OF UNCHANGED MARKERS ***************/
+
+// retentionEntry is an archive or an unchanged marker seen during rotation.
+// A marker always refers to the newest archive written before it, so
+// ordering by time is enough to know which archive it depends on, both
+// locally and on FTP where the marker content is not read.
+type retentionEntry struct {
+	Name   string
+	Time   time.Time
+	Marker bool
+}
+
+// newRetentionEntry names split archives by their logical X.tar.gz name.
+func newRetentionEntry(name string, t time.Time) (retentionEntry, bool) {
+	if logical, ok := archiveLogicalName(name); ok {
+		return retentionEntry{Name: logical, Time: t}, true
+	}
+	if strings.HasSuffix(name, unchangedSuffix) {
+		return retentionEntry{Name: name, Time: t, Marker: true}, true
+	}
+	return retentionEntry{}, false
+}
+
+// removeEntry deletes a marker or an archive together with its volumes and sidecars.
+func removeEntry(dir string, e retentionEntry) {
+	if e.Marker {
+		_ = os.Remove(filepath.Join(dir, e.Name))
+		return
+	}
+	removeArchive(filepath.Join(dir, e.Name))
+}
+
+func localRetentionEntries(dir string) []retentionEntry {
+	files, _ := os.ReadDir(dir)
+	var out []retentionEntry
 	for _, f := range files {
-		if info, err := os.Stat(f); err == nil && info.ModTime().Before(cutoff) {
-			log.Printf("🧹 Deleting old archive %s", filepath.Base(f))
-			_ = os.Remove(f)
+		if f.IsDir() {
+			continue
+		}
+		info, err := f.Info()
+		if err != nil {
+			continue
+		}
+		if e, ok := newRetentionEntry(f.Name(), info.ModTime()); ok {
+			out = append(out, e)
 		}
 	}
+	return out
 }
 
-func acquireLock() {
+// walkReferences calls fn for every marker together with the archive it refers to.
+func walkReferences(entries []retentionEntry, fn func(marker, archive string)) {
+	sorted := append([]retentionEntry(nil), entries...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Time.Before(sorted[j].Time) })
+
+	var current string
+	for _, e := range sorted {
+		if !e.Marker {
+			current = e.Name
+			continue
+		}
+		fn(e.Name, current)
+	}
+}
+
+// keepReferencedArchives un-drops archives that a surviving marker still points to.
+func keepReferencedArchives(entries []retentionEntry, drop map[string]bool) {
+	walkReferences(entries, func(marker, archive string) {
+		if archive != "" && !drop[marker] {
+			delete(drop, archive)
+		}
+	})
+}
+
+// dropDanglingMarkers drops markers whose archive is going away.
+func dropDanglingMarkers(entries []retentionEntry, drop map[string]bool) {
+	walkReferences(entries, func(marker, archive string) {
+		if archive == "" || drop[archive] {
+			drop[marker] = true
+		}
+	})
+}
+
+// tryLock takes the lock file of the backup run. Restores and rollbacks take
+// it as well, so an RDB is never replaced while a backup of it is archived.
+func tryLock() error {
 	try := func() error {
 		f, err := os.OpenFile(lockFile, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
 		if err != nil {
@@ -1137,7 +1966,7 @@ func acquireLock() {
 	}
 
 	if err := try(); err == nil {
-		return
+		return nil
 	}
 
 	// файл существует – проверяем жив ли владелец
@@ -1145,14 +1974,21 @@ func acquireLock() {
 	if pid, _ := strconv.Atoi(strings.TrimSpace(string(data))); pid > 0 {
 		if proc, _ := os.FindProcess(pid); proc != nil &&
 			proc.Signal(syscall.Signal(0)) == nil {
-			log.Fatalf("%sBackup already running (PID %d)%s", red, pid, reset)
+			return fmt.Errorf("another redis-backup run is busy (PID %d)", pid)
 		}
 	}
 
 	// владелец умер – удаляем «висящий» лок и пробуем ещё раз
 	_ = os.Remove(lockFile)
 	if err := try(); err != nil {
-		log.Fatalf("%sCannot create lock file: %v%s", red, err, reset)
+		return fmt.Errorf("cannot create lock file: %v", err)
+	}
+	return nil
+}
+
+func acquireLock() {
+	if err := tryLock(); err != nil {
+		log.Fatalf("%s%v%s", red, err, reset)
 	}
 }
 
@@ -1160,13 +1996,24 @@ func releaseLock() {
 	_ = os.Remove(lockFile)
 }
 
+// fileID identifies an inode so hardlinked tier copies are counted once.
+type fileID struct{ dev, ino uint64 }
+
 func dirSize(root string) (int64, error) {
 	var sum int64
+	seen := make(map[fileID]struct{})
 	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
-		if err != nil || d.IsDir() || !strings.HasSuffix(d.Name(), ".tar.gz") {
+		if err != nil || d.IsDir() || !isArchiveData(d.Name()) {
 			return err
 		}
 		if fi, err := os.Stat(path); err == nil {
+			if st, ok := fi.Sys().(*syscall.Stat_t); ok && st.Nlink > 1 {
+				id := fileID{dev: uint64(st.Dev), ino: uint64(st.Ino)}
+				if _, dup := seen[id]; dup {
+					return nil
+				}
+				seen[id] = struct{}{}
+			}
 			sum += fi.Size()
 		}
 		return nil
@@ -1219,19 +2066,32 @@ func isRedisHealthy(port string) bool {
 }
 
 // rotateCopies keeps only <copies> newest *.tar.gz in dir.
+// Unchanged markers pointing at a removed archive go with it.
 func rotateCopies(dir string, copies int) {
-	files, _ := filepath.Glob(filepath.Join(dir, "*.tar.gz"))
+	backups := localRetentionEntries(dir)
+	var files []retentionEntry
+	for _, e := range backups {
+		if !e.Marker {
+			files = append(files, e)
+		}
+	}
 	if len(files) <= copies {
 		return
 	}
 	sort.Slice(files, func(i, j int) bool {
-		fi, _ := os.Stat(files[i])
-		fj, _ := os.Stat(files[j])
-		return fi.ModTime().After(fj.ModTime())
+		return files[i].Time.After(files[j].Time)
 	})
-	for _, f := range files[copies:] {
-		log.Printf("🧹 Deleting extra archive %s", filepath.Base(f))
-		_ = os.Remove(f)
+	drop := make(map[string]bool)
+	for _, e := range files[copies:] {
+		drop[e.Name] = true
+	}
+	dropDanglingMarkers(backups, drop)
+
+	for _, e := range backups {
+		if drop[e.Name] {
+			logRemoval("extra archive", filepath.Join(dir, e.Name))
+			removeEntry(dir, e)
+		}
 	}
 }
 
@@ -1242,11 +2102,17 @@ func rotateCopiesFTP(c *ftp.ServerConn, dir string, copies int) {
 		return
 	}
 
-	// работаем с указателями
-	var files []*ftp.Entry
+	var files []retentionEntry
+	var backups []retentionEntry
 	for _, e := range entries {
-		if e.Type == ftp.EntryTypeFile && strings.HasSuffix(e.Name, ".tar.gz") {
-			files = append(files, e)
+		if e.Type != ftp.EntryTypeFile {
+			continue
+		}
+		if re, ok := newRetentionEntry(e.Name, e.Time); ok {
+			backups = append(backups, re)
+			if !re.Marker {
+				files = append(files, re)
+			}
 		}
 	}
 	if len(files) <= copies {
@@ -1258,10 +2124,19 @@ func rotateCopiesFTP(c *ftp.ServerConn, dir string, copies int) {
 		return files[i].Time.After(files[j].Time)
 	})
 
-	// удаляем «лишние» файлы
+	drop := make(map[string]bool)
 	for _, e := range files[copies:] {
+		drop[e.Name] = true
+	}
+	dropDanglingMarkers(backups, drop)
+
+	// удаляем «лишние» файлы
+	for _, e := range backups {
+		if !drop[e.Name] {
+			continue
+		}
 		remoteFile := filepath.ToSlash(filepath.Join(dir, e.Name))
 		log.Printf("🧹 (FTP) Deleting extra archive %s", remoteFile)
-		_ = c.Delete(remoteFile)
+		ftpRemoveArchive(c, dir, e.Name, entries)
 	}
 }
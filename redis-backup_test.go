@@ -0,0 +1,91 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// retentionFixture lists names in time order, one hour apart.
+func retentionFixture(names ...string) []retentionEntry {
+	base := time.Date(2025, 1, 1, 3, 0, 0, 0, time.UTC)
+	var out []retentionEntry
+	for i, n := range names {
+		e, ok := newRetentionEntry(n, base.Add(time.Duration(i)*time.Hour))
+		if !ok {
+			panic("not a retention entry: " + n)
+		}
+		out = append(out, e)
+	}
+	return out
+}
+
+func dropped(drop map[string]bool) []string {
+	var out []string
+	for name, ok := range drop {
+		if ok {
+			out = append(out, name)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+func TestKeepReferencedArchives(t *testing.T) {
+	entries := retentionFixture("a.tar.gz", "a1.unchanged", "b.tar.gz", "b1.unchanged", "b2.unchanged")
+	tests := []struct {
+		name string
+		drop []string
+		want []string
+	}{
+		{"nothing due", nil, nil},
+		{"archive kept by its marker", []string{"a.tar.gz"}, nil},
+		{"archive and its only marker", []string{"a.tar.gz", "a1.unchanged"}, []string{"a.tar.gz", "a1.unchanged"}},
+		{"one of two markers survives", []string{"b.tar.gz", "b1.unchanged"}, []string{"b1.unchanged"}},
+		{"all markers of an archive", []string{"b.tar.gz", "b1.unchanged", "b2.unchanged"}, []string{"b.tar.gz", "b1.unchanged", "b2.unchanged"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			drop := make(map[string]bool)
+			for _, n := range tt.drop {
+				drop[n] = true
+			}
+			keepReferencedArchives(entries, drop)
+			if got := dropped(drop); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("dropped %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDropDanglingMarkers(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []retentionEntry
+		drop    []string
+		want    []string
+	}{
+		{"archive stays", retentionFixture("a.tar.gz", "a1.unchanged"), nil, nil},
+		{"marker follows its archive", retentionFixture("a.tar.gz", "a1.unchanged", "b.tar.gz", "b1.unchanged"),
+			[]string{"a.tar.gz"}, []string{"a.tar.gz", "a1.unchanged"}},
+		{"marker without any archive", retentionFixture("x.unchanged", "a.tar.gz"), nil, []string{"x.unchanged"}},
+		{"later archive keeps later markers", retentionFixture("a.tar.gz", "b.tar.gz", "b1.unchanged"),
+			[]string{"a.tar.gz"}, []string{"a.tar.gz"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			drop := make(map[string]bool)
+			for _, n := range tt.drop {
+				drop[n] = true
+			}
+			dropDanglingMarkers(tt.entries, drop)
+			if got := dropped(drop); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("dropped %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
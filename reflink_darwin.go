@@ -0,0 +1,11 @@
+//go:build darwin
+// +build darwin
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// reflinkFile uses APFS clonefile(2), copy-on-write without extra space.
+func reflinkFile(src, dst string) error {
+	return unix.Clonefile(src, dst, 0)
+}
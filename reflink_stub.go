@@ -0,0 +1,11 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package main
+
+import "errors"
+
+// заглушка: на остальных ОС reflink не поддерживается, будет обычная копия.
+func reflinkFile(string, string) error {
+	return errors.New("reflink not supported on this platform")
+}
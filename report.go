@@ -0,0 +1,324 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"container/heap"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/************************ REPORT ************************/
+// report answers "what is eating the memory" from a backup, without
+// touching the live instance: biggest keys, key prefixes, collection sizes
+// and how TTLs are spread.
+
+type bigKey struct {
+	DB       int    `json:"db"`
+	Key      string `json:"key"`
+	Type     string `json:"type"`
+	Bytes    int64  `json:"bytes"`
+	Elements int64  `json:"elements"`
+}
+
+// bigKeyHeap is a min-heap, so the smallest of the current top N is dropped first.
+type bigKeyHeap []bigKey
+
+func (h bigKeyHeap) Len() int            { return len(h) }
+func (h bigKeyHeap) Less(i, j int) bool  { return h[i].Bytes < h[j].Bytes }
+func (h bigKeyHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *bigKeyHeap) Push(x interface{}) { *h = append(*h, x.(bigKey)) }
+func (h *bigKeyHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+type prefixStat struct {
+	Prefix string `json:"prefix"`
+	Keys   int64  `json:"keys"`
+	Bytes  int64  `json:"bytes"`
+}
+
+type collectionStat struct {
+	Type     string `json:"type"`
+	Keys     int64  `json:"keys"`
+	Elements int64  `json:"elements"`
+	Max      int64  `json:"max_elements"`
+}
+
+type ttlBucket struct {
+	Bucket string `json:"bucket"`
+	Keys   int64  `json:"keys"`
+}
+
+type keyReport struct {
+	Archive     string           `json:"archive"`
+	Keys        int64            `json:"keys"`
+	Bytes       int64            `json:"bytes"`
+	BigKeys     []bigKey         `json:"big_keys"`
+	Prefixes    []prefixStat     `json:"prefixes"`
+	Collections []collectionStat `json:"collections"`
+	TTL         []ttlBucket      `json:"ttl"`
+}
+
+// ttl buckets, relative to the snapshot time
+var ttlBuckets = []struct {
+	Name  string
+	Limit time.Duration
+}{
+	{"< 1h", time.Hour},
+	{"< 1d", 24 * time.Hour},
+	{"< 7d", 7 * 24 * time.Hour},
+	{"< 30d", 30 * 24 * time.Hour},
+	{">= 30d", 1<<63 - 1},
+}
+
+// elementCount is the number of items in a collection (1 for strings).
+func elementCount(e *rdbEntry) int64 {
+	switch v := e.Value.(type) {
+	case [][]byte:
+		return int64(len(v))
+	case []zsetMember:
+		return int64(len(v))
+	case []hashField:
+		return int64(len(v))
+	case *rdbStream:
+		return int64(v.Length)
+	}
+	return 1
+}
+
+// keyPrefix is the part before the first delimiter, "(none)" without one.
+func keyPrefix(key []byte) string {
+	if prefixDelimiter == "" {
+		return "(none)"
+	}
+	if i := strings.Index(string(key), prefixDelimiter); i >= 0 {
+		return displayKey(key[:i])
+	}
+	return "(none)"
+}
+
+func buildKeyReport(path string) (*keyReport, error) {
+	snapshot := time.Now()
+	if meta, err := readBackupMeta(path); err == nil && meta.SnapshotTime > 0 {
+		snapshot = time.Unix(meta.SnapshotTime, 0)
+	} else if t, err := archiveModTime(path); err == nil {
+		snapshot = t
+	}
+
+	a, err := openArchivedRDB(path)
+	if err != nil {
+		return nil, err
+	}
+	defer a.Close()
+
+	r := &keyReport{Archive: path}
+	top := &bigKeyHeap{}
+	prefixes := make(map[string]*prefixStat)
+	collections := make(map[string]*collectionStat)
+	ttl := make(map[string]int64)
+
+	_, err = parseRDB(a, captureNone, func(e *rdbEntry) error {
+		if filterDB >= 0 && e.DB != filterDB {
+			return nil
+		}
+		if keyPattern != "" && !globMatch([]byte(keyPattern), e.Key) {
+			return nil
+		}
+		size := int64(len(e.Key)) + e.Size
+		typ := rdbTypeName(e.Type)
+		n := elementCount(e)
+		r.Keys++
+		r.Bytes += size
+
+		heap.Push(top, bigKey{DB: e.DB, Key: displayKey(e.Key), Type: typ, Bytes: size, Elements: n})
+		if top.Len() > reportTop {
+			heap.Pop(top)
+		}
+
+		p := keyPrefix(e.Key)
+		if prefixes[p] == nil {
+			prefixes[p] = &prefixStat{Prefix: p}
+		}
+		prefixes[p].Keys++
+		prefixes[p].Bytes += size
+
+		if typ != "string" && typ != "module" {
+			if collections[typ] == nil {
+				collections[typ] = &collectionStat{Type: typ}
+			}
+			c := collections[typ]
+			c.Keys++
+			c.Elements += n
+			if n > c.Max {
+				c.Max = n
+			}
+		}
+
+		switch {
+		case e.ExpireMs == 0:
+			ttl["none"]++
+		case e.ExpireMs <= snapshot.UnixMilli():
+			ttl["expired"]++
+		default:
+			left := time.UnixMilli(e.ExpireMs).Sub(snapshot)
+			for _, b := range ttlBuckets {
+				if left < b.Limit {
+					ttl[b.Name]++
+					break
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	r.BigKeys = append(r.BigKeys, (*top)...)
+	sort.Slice(r.BigKeys, func(i, j int) bool { return r.BigKeys[i].Bytes > r.BigKeys[j].Bytes })
+
+	for _, p := range prefixes {
+		r.Prefixes = append(r.Prefixes, *p)
+	}
+	sort.Slice(r.Prefixes, func(i, j int) bool {
+		if r.Prefixes[i].Bytes != r.Prefixes[j].Bytes {
+			return r.Prefixes[i].Bytes > r.Prefixes[j].Bytes
+		}
+		return r.Prefixes[i].Prefix < r.Prefixes[j].Prefix
+	})
+	if len(r.Prefixes) > reportTop {
+		r.Prefixes = r.Prefixes[:reportTop]
+	}
+
+	for _, c := range collections {
+		r.Collections = append(r.Collections, *c)
+	}
+	sort.Slice(r.Collections, func(i, j int) bool { return r.Collections[i].Type < r.Collections[j].Type })
+
+	for _, name := range []string{"none", "expired"} {
+		r.TTL = append(r.TTL, ttlBucket{Bucket: name, Keys: ttl[name]})
+	}
+	for _, b := range ttlBuckets {
+		r.TTL = append(r.TTL, ttlBucket{Bucket: b.Name, Keys: ttl[b.Name]})
+	}
+	return r, nil
+}
+
+func cmdReport(args []string) int {
+	format := outputFormat
+	if format == "" {
+		format = "table"
+	}
+	if format != "table" && format != "csv" && format != "json" {
+		fmt.Fprintf(os.Stderr, "%sreport: --format must be table, csv or json%s\n", red, reset)
+		return 2
+	}
+
+	var path string
+	switch {
+	case len(args) == 1:
+		p, err := locateArchive(args[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%sreport: %v%s\n", red, err, reset)
+			return 2
+		}
+		path = p
+	case len(args) == 0 && targetPort != "":
+		daily := dailyArchives(targetPort)
+		if len(daily) == 0 {
+			fmt.Fprintf(os.Stderr, "%sreport: no daily archives for port %s%s\n", red, targetPort, reset)
+			return 2
+		}
+		path = daily[len(daily)-1]
+	default:
+		fmt.Fprintf(os.Stderr, "%sreport: give one archive, or --port for the newest daily one%s\n", red, reset)
+		return 2
+	}
+
+	r, err := buildKeyReport(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s%s: %v%s\n", red, path, err, reset)
+		return 2
+	}
+
+	switch format {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(r); err != nil {
+			return 2
+		}
+	case "csv":
+		if err := writeReportCSV(r); err != nil {
+			fmt.Fprintf(os.Stderr, "%s%v%s\n", red, err, reset)
+			return 2
+		}
+	default:
+		printReportTable(r)
+	}
+	return 0
+}
+
+// writeReportCSV puts all sections into one table with a "section" column.
+func writeReportCSV(r *keyReport) error {
+	w := csv.NewWriter(os.Stdout)
+	i64 := func(n int64) string { return strconv.FormatInt(n, 10) }
+	_ = w.Write([]string{"section", "db", "name", "type", "keys", "bytes", "elements", "max_elements"})
+	for _, k := range r.BigKeys {
+		_ = w.Write([]string{"big_key", strconv.Itoa(k.DB), k.Key, k.Type, "1", i64(k.Bytes), i64(k.Elements), ""})
+	}
+	for _, p := range r.Prefixes {
+		_ = w.Write([]string{"prefix", "", p.Prefix, "", i64(p.Keys), i64(p.Bytes), "", ""})
+	}
+	for _, c := range r.Collections {
+		_ = w.Write([]string{"collection", "", "", c.Type, i64(c.Keys), "", i64(c.Elements), i64(c.Max)})
+	}
+	for _, t := range r.TTL {
+		_ = w.Write([]string{"ttl", "", t.Bucket, "", i64(t.Keys), "", "", ""})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+func printReportTable(r *keyReport) {
+	fmt.Printf("%s%s%s — %d keys, %.1f MB serialized\n", cyan, r.Archive, reset, r.Keys, humanMB(r.Bytes))
+
+	fmt.Printf("\n%sBIGGEST KEYS%s\n", cyan, reset)
+	fmt.Printf("%-5s %-8s %12s %10s  %s\n", "DB", "TYPE", "BYTES", "ELEMENTS", "KEY")
+	for _, k := range r.BigKeys {
+		fmt.Printf("db%-3d %-8s %12d %10d  %s\n", k.DB, k.Type, k.Bytes, k.Elements, k.Key)
+	}
+
+	fmt.Printf("\n%sPREFIXES (delimiter %q)%s\n", cyan, prefixDelimiter, reset)
+	fmt.Printf("%-30s %10s %12s %7s\n", "PREFIX", "KEYS", "BYTES", "SHARE")
+	for _, p := range r.Prefixes {
+		share := 0.0
+		if r.Bytes > 0 {
+			share = float64(p.Bytes) / float64(r.Bytes) * 100
+		}
+		fmt.Printf("%-30s %10d %12d %6.1f%%\n", p.Prefix, p.Keys, p.Bytes, share)
+	}
+
+	fmt.Printf("\n%sCOLLECTIONS%s\n", cyan, reset)
+	fmt.Printf("%-8s %10s %14s %12s %12s\n", "TYPE", "KEYS", "ELEMENTS", "AVG", "MAX")
+	for _, c := range r.Collections {
+		fmt.Printf("%-8s %10d %14d %12.1f %12d\n", c.Type, c.Keys, c.Elements, float64(c.Elements)/float64(c.Keys), c.Max)
+	}
+
+	fmt.Printf("\n%sTTL (at snapshot time)%s\n", cyan, reset)
+	for _, t := range r.TTL {
+		fmt.Printf("%-8s %10d\n", t.Bucket, t.Keys)
+	}
+}
@@ -0,0 +1,142 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+/********************** RESP **********************/
+// Redis protocol encoding. Commands are written as arrays of bulk strings,
+// the form `redis-cli --pipe` and the server itself expect. Most of the tool
+// talks to Redis through redis-cli; commands that send binary payloads
+// (RESTORE) use the small client below.
+
+func writeRESPCommand(w *bufio.Writer, args ...[]byte) error {
+	w.WriteByte('*')
+	w.WriteString(strconv.Itoa(len(args)))
+	w.WriteString("\r\n")
+	for _, a := range args {
+		w.WriteByte('$')
+		w.WriteString(strconv.Itoa(len(a)))
+		w.WriteString("\r\n")
+		w.Write(a)
+		if _, err := w.WriteString("\r\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// respArgs converts mixed string / []byte arguments.
+func respArgs(args ...interface{}) [][]byte {
+	out := make([][]byte, len(args))
+	for i, a := range args {
+		switch v := a.(type) {
+		case []byte:
+			out[i] = v
+		case string:
+			out[i] = []byte(v)
+		case int:
+			out[i] = []byte(strconv.Itoa(v))
+		case int64:
+			out[i] = []byte(strconv.FormatInt(v, 10))
+		}
+	}
+	return out
+}
+
+/*************** CLIENT ***************/
+
+// redisError is an error reply (-ERR …, -BUSYKEY …) as opposed to a
+// connection problem.
+type redisError string
+
+func (e redisError) Error() string { return string(e) }
+
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+// dialRedis connects to a local instance. Like redis-cli it takes the
+// password from REDISCLI_AUTH.
+func dialRedis(port string) (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", port), 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+	if pass := os.Getenv("REDISCLI_AUTH"); pass != "" {
+		if _, err := c.do("AUTH", pass); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (c *redisConn) Close() error { return c.conn.Close() }
+
+// do sends one command and reads its reply: string (status), []byte (bulk),
+// int64, []interface{} (array) or nil.
+func (c *redisConn) do(args ...interface{}) (interface{}, error) {
+	if err := writeRESPCommand(c.w, respArgs(args...)...); err != nil {
+		return nil, err
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+func (c *redisConn) readReply() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("malformed reply from Redis")
+	}
+	body := line[1 : len(line)-2]
+	switch line[0] {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, redisError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < 0 {
+			return nil, err // $-1 = nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		out := make([]interface{}, n)
+		for i := range out {
+			if out[i], err = c.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("unexpected reply type %q", line[0])
+}
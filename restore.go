@@ -0,0 +1,418 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+/****************** SCRIPTED RESTORE ******************/
+// restore does what the --restore wizard does, but takes every answer from
+// flags so it can run from scripts and configuration management.
+
+// exit codes of the restore command
+const (
+	exitRestoreUsage   = 2 // bad arguments, archive or instance not found
+	exitRestoreRefused = 3 // a pre-restore check failed, nothing was changed
+	exitRestoreFailed  = 4 // failed while replacing or verifying the RDB
+)
+
+// restoreError carries the exit code for a failed restore.
+type restoreError struct {
+	Code int
+	Err  error
+}
+
+func (e *restoreError) Error() string { return e.Err.Error() }
+
+func restoreFailf(code int, format string, args ...interface{}) error {
+	return &restoreError{Code: code, Err: fmt.Errorf(format, args...)}
+}
+
+// restoreResult describes what was restored (printed with --format json).
+type restoreResult struct {
+	SourcePort      string   `json:"source_port"`
+	TargetPort      string   `json:"target_port"`
+	Archive         string   `json:"archive"`
+	Tier            string   `json:"tier"`
+	SnapshotTime    string   `json:"snapshot_time,omitempty"`
+	Keys            int64    `json:"keys,omitempty"`
+	RDBFile         string   `json:"rdb_file"`
+	PreviousFile    string   `json:"previous_file,omitempty"`
+	SnapshotArchive string   `json:"snapshot_archive,omitempty"`
+	JournalID       int      `json:"journal_id,omitempty"`
+	Warnings        []string `json:"warnings,omitempty"`
+}
+
+// archiveStamp returns the time encoded in an archive name, or its mtime.
+func archiveStamp(path string) time.Time {
+	if t, ok := nameStamp(filepath.Base(path)); ok {
+		return t
+	}
+	t, _ := archiveModTime(path)
+	return t
+}
+
+// nameStamp parses the timestamp an archive or marker name starts with.
+func nameStamp(name string) (time.Time, bool) {
+	if len(name) < 19 {
+		return time.Time{}, false
+	}
+	t, err := time.ParseInLocation("2006-01-02_15-04-05", name[:19], time.Local)
+	return t, err == nil
+}
+
+// tieredArchive is an archive (or unchanged marker) in one of the tiers.
+type tieredArchive struct {
+	Path   string
+	Tier   string
+	Time   time.Time
+	Marker bool
+}
+
+// instanceArchives lists the archives of an instance directory in the given
+// tiers (all when empty), oldest first; copies of the same snapshot in
+// several tiers keep the tier order.
+func instanceArchives(instDir string, tiers []string) []tieredArchive {
+	if len(tiers) == 0 {
+		tiers = backupTiers
+	}
+	var out []tieredArchive
+	for _, tier := range tiers {
+		dir := filepath.Join(instDir, tier)
+		for _, e := range localRetentionEntries(dir) {
+			p := filepath.Join(dir, e.Name)
+			out = append(out, tieredArchive{Path: p, Tier: tier, Time: archiveStamp(p), Marker: e.Marker})
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Time.Before(out[j].Time) })
+	return out
+}
+
+// restoreTiers returns the tiers selected with --tier.
+func restoreTiers() []string {
+	if restoreTier == "" {
+		return nil
+	}
+	return []string{restoreTier}
+}
+
+// tierLabel names the tiers searched, for messages.
+func tierLabel() string {
+	if restoreTier == "" {
+		return "any tier"
+	}
+	return restoreTier
+}
+
+// restoreAt returns the --at time, zero for --latest.
+func restoreAt(latest bool) (time.Time, error) {
+	if atTime != "" {
+		return parseTimeArg(atTime)
+	}
+	if !latest {
+		return time.Time{}, fmt.Errorf("name an archive, or use --latest or --at <time>")
+	}
+	return time.Time{}, nil
+}
+
+// pickArchive returns the index and snapshot time of the newest archive
+// whose snapshot was taken at or before at (the newest one when at is zero);
+// -1 if there is none. bounds[i] is an upper bound of the i-th snapshot time
+// (the time in the name, or the snapshot time when already known) and
+// snapshot(i) returns the real one; it is only called for archives that can
+// still win. Of equal times the first wins, so list the preferred copy
+// (local, shorter tier) first.
+func pickArchive(bounds []time.Time, at time.Time, snapshot func(int) time.Time) (int, time.Time) {
+	order := make([]int, len(bounds))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return bounds[order[a]].After(bounds[order[b]]) })
+
+	best, bestTime := -1, time.Time{}
+	beats := func(i int, t time.Time) bool {
+		return best < 0 || t.After(bestTime) || t.Equal(bestTime) && i < best
+	}
+	for _, i := range order {
+		if !beats(i, bounds[i]) {
+			break // the rest are bounded lower still
+		}
+		if t := snapshot(i); (at.IsZero() || !t.After(at)) && beats(i, t) {
+			best, bestTime = i, t
+		}
+	}
+	return best, bestTime
+}
+
+// noArchiveError explains why pickArchive found nothing.
+func noArchiveError(port string, at time.Time) error {
+	if sourceHost != "" {
+		port += " of host " + sourceHost
+	}
+	if !at.IsZero() {
+		return fmt.Errorf("no archive of Redis %s (%s) with a snapshot at or before %s", port, tierLabel(), at.Format("2006-01-02 15:04:05"))
+	}
+	return fmt.Errorf("no archives of Redis %s (%s)", port, tierLabel())
+}
+
+// localSnapshotTime is when the RDB in a local archive was written, from
+// its .meta (or the unchanged marker); the time in the name otherwise.
+func localSnapshotTime(a tieredArchive) time.Time {
+	var snap int64
+	if a.Marker {
+		if m, err := readUnchangedMarker(a.Path); err == nil {
+			snap = m.SnapshotTime
+		}
+	} else if meta, err := readBackupMeta(a.Path); err == nil {
+		snap = meta.SnapshotTime
+	}
+	if snap > 0 {
+		return time.Unix(snap, 0)
+	}
+	return a.Time
+}
+
+// restoreCandidate is an archive restore can pick: a local one, or all FTP
+// copies of a remote one.
+type restoreCandidate struct {
+	Path     string          // local archive or marker
+	Copies   []remoteArchive // FTP copies; nil for a local archive
+	Tier     string
+	Snapshot time.Time
+}
+
+func (c restoreCandidate) String() string {
+	if c.Copies != nil {
+		return c.Copies[0].String()
+	}
+	return c.Path
+}
+
+func localCandidates(port string) []restoreCandidate {
+	var out []restoreCandidate
+	for _, a := range instanceArchives(filepath.Join(sourceBackupRoot(), "redis_"+port), restoreTiers()) {
+		out = append(out, restoreCandidate{Path: a.Path, Tier: a.Tier, Snapshot: localSnapshotTime(a)})
+	}
+	return out
+}
+
+// remoteCandidates lists the archives on FTP once each, with all copies.
+// Snapshot is the time in the name until the .meta has been read.
+func remoteCandidates(port string) []restoreCandidate {
+	all := listRemoteArchives(port, restoreTiers())
+	var out []restoreCandidate
+	seen := make(map[string]bool)
+	for _, r := range all {
+		if !seen[r.Name] {
+			seen[r.Name] = true
+			out = append(out, restoreCandidate{Copies: sameRemoteArchive(all, r), Tier: r.Tier, Snapshot: r.Time})
+		}
+	}
+	return out
+}
+
+// selectArchive resolves the archive named on the command line, or picks the
+// newest one of --port whose snapshot was taken at or before --at (--latest:
+// the newest one) from all tiers. --at also looks at the FTP replicas when
+// accounts are configured, --latest only at the local tree; --from-ftp only
+// at the replicas.
+func selectArchive(args []string, latest bool) (restoreCandidate, error) {
+	port := targetPort
+	if len(args) == 1 {
+		if fromFTP {
+			if m := archiveNameRe.FindStringSubmatch(args[0]); m != nil && port == "" {
+				port = m[1]
+			}
+			if port == "" {
+				return restoreCandidate{}, fmt.Errorf("--port is required without an archive name")
+			}
+			for _, c := range remoteCandidates(port) {
+				if c.Copies[0].Name == filepath.Base(args[0]) {
+					return c, nil
+				}
+			}
+			return restoreCandidate{}, fmt.Errorf("archive %s not found on FTP", args[0])
+		}
+		if filepath.Base(args[0]) == args[0] && port != "" {
+			for _, c := range localCandidates(port) {
+				if filepath.Base(c.Path) == args[0] {
+					return c, nil
+				}
+			}
+		}
+		p, err := locateArchive(args[0])
+		return restoreCandidate{Path: p, Tier: filepath.Base(filepath.Dir(p))}, err
+	}
+
+	if port == "" {
+		return restoreCandidate{}, fmt.Errorf("--port is required without an archive name")
+	}
+	at, err := restoreAt(latest)
+	if err != nil {
+		return restoreCandidate{}, err
+	}
+	var cands []restoreCandidate
+	if !fromFTP {
+		cands = localCandidates(port)
+	}
+	if fromFTP || (!at.IsZero() && ftpEnabled) {
+		local := make(map[string]bool)
+		for _, c := range cands {
+			local[filepath.Base(c.Path)] = true
+		}
+		for _, c := range remoteCandidates(port) {
+			if !local[c.Copies[0].Name] { // the local copy of an archive is preferred
+				cands = append(cands, c)
+			}
+		}
+	}
+	bounds := make([]time.Time, len(cands))
+	for i, c := range cands {
+		bounds[i] = c.Snapshot
+	}
+	remote := newRemoteSnapshots()
+	defer remote.close()
+	i, snap := pickArchive(bounds, at, func(i int) time.Time {
+		if cands[i].Copies == nil {
+			return cands[i].Snapshot
+		}
+		return remote.time(cands[i].Copies[0])
+	})
+	if i < 0 {
+		return restoreCandidate{}, noArchiveError(port, at)
+	}
+	c := cands[i]
+	c.Snapshot = snap
+	return c, nil
+}
+
+func printJSON(v interface{}) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
+
+// restoreExitCode maps a restoreBackup error to the exit code.
+func restoreExitCode(err error) int {
+	if re, ok := err.(*restoreError); ok {
+		return re.Code
+	}
+	return exitRestoreFailed
+}
+
+func cmdRestore(args []string) int {
+	if len(args) > 1 || (len(args) == 1 && (restoreLatest || atTime != "")) {
+		fmt.Fprintf(os.Stderr, "%susage: restore (<archive> | --port P --latest | --port P --at <time>) [--tier T] [--target-port P] --yes%s\n", red, reset)
+		return exitRestoreUsage
+	}
+	switch restoreTier {
+	case "", "daily", "weekly", "monthly", "yearly":
+	default:
+		fmt.Fprintf(os.Stderr, "%s--tier must be daily, weekly, monthly or yearly%s\n", red, reset)
+		return exitRestoreUsage
+	}
+	if outputFormat != "" && outputFormat != "json" && outputFormat != "text" {
+		fmt.Fprintf(os.Stderr, "%srestore: --format must be text or json%s\n", red, reset)
+		return exitRestoreUsage
+	}
+
+	if fromFTP || atTime != "" {
+		loadFTPAccounts()
+	}
+	if fromFTP && !ftpEnabled {
+		fmt.Fprintf(os.Stderr, "%sNo FTP accounts configured (%s or --ftp-host)%s\n", red, ftpConfFile, reset)
+		return exitRestoreUsage
+	}
+	chosen, err := selectArchive(args, restoreLatest)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s%v%s\n", red, err, reset)
+		return exitRestoreUsage
+	}
+	archive, source, copies := chosen.Path, "", chosen.Copies
+	if copies != nil {
+		archive, source = copies[0].Name, chosen.String()
+	}
+	if len(args) == 0 {
+		where := "local"
+		if copies != nil {
+			where = "FTP " + copies[0].Account.Host
+		}
+		log.Printf("%s🎯 %s/%s (%s), snapshot %s%s", cyan, chosen.Tier, filepath.Base(chosen.String()), where, chosen.Snapshot.Format("2006-01-02 15:04:05"), reset)
+	}
+
+	target := intoPort
+	if target == "" {
+		target = targetPort
+	}
+	if target == "" {
+		if m := archiveNameRe.FindStringSubmatch(archive); m != nil {
+			target = m[1]
+		}
+	}
+	if target == "" {
+		fmt.Fprintf(os.Stderr, "%scannot tell which instance to restore, use --target-port%s\n", red, reset)
+		return exitRestoreUsage
+	}
+
+	if !assumeYes && !dryRun {
+		if source != "" {
+			archive = source
+		}
+		fmt.Fprintf(os.Stderr, "%sRedis %s would be restored from %s; add --yes to do it (or --dry-run for the plan)%s\n", yellow, target, archive, reset)
+		return exitRestoreUsage
+	}
+
+	if copies != nil {
+		local, tmpDir, src, err := fetchRemoteArchive(copies)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s%v%s\n", red, err, reset)
+			return exitRestoreRefused
+		}
+		defer os.RemoveAll(tmpDir)
+		archive, source = local, src.String()
+	}
+
+	plan, err := planRestore(archive, target)
+	if plan != nil && source != "" {
+		plan.Archive = source
+	}
+	if dryRun {
+		if plan != nil {
+			if outputFormat == "json" {
+				printJSON(plan)
+			} else {
+				printPlan(plan)
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s%v%s\n", red, err, reset)
+			return restoreExitCode(err)
+		}
+		return 0
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s%v%s\n", red, err, reset)
+		return restoreExitCode(err)
+	}
+
+	res, err := plan.execute()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s%v%s\n", red, err, reset)
+		return restoreExitCode(err)
+	}
+
+	if outputFormat == "json" {
+		printJSON(res)
+		return 0
+	}
+	fmt.Printf("%s✔ Redis %s restored from %s (%s)%s\n", green, res.TargetPort, filepath.Base(res.Archive), res.Tier, reset)
+	return 0
+}
@@ -0,0 +1,59 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPickArchive(t *testing.T) {
+	base := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	h := func(n int) time.Time { return base.Add(time.Duration(n) * time.Hour) }
+	tests := []struct {
+		name      string
+		bounds    []int // time in the name, hours after base
+		snapshots []int // real snapshot time
+		at        int   // -1 = --latest
+		want      int
+		lookups   []int // archives whose snapshot time is read, in order
+	}{
+		{"nothing", nil, nil, -1, -1, nil},
+		{"latest", []int{1, 3, 2}, []int{1, 3, 2}, -1, 1, []int{1}},
+		{"newest at or before at", []int{1, 2, 3}, []int{1, 2, 3}, 2, 1, []int{2, 1}},
+		{"at is inclusive", []int{1, 2}, []int{1, 2}, 2, 1, []int{1}},
+		{"none old enough", []int{5, 6}, []int{5, 6}, 2, -1, []int{1, 0}},
+		{"snapshot older than its name", []int{1, 10}, []int{1, 2}, 3, 1, []int{1}},
+		{"snapshot decides, not the name", []int{4, 5}, []int{3, 1}, 3, 0, []int{1, 0}},
+		{"first of equal times wins", []int{2, 2}, []int{2, 2}, -1, 0, []int{0}},
+		{"older names are not looked up", []int{1, 2, 8, 9}, []int{1, 2, 7, 8}, 7, 2, []int{3, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bounds := make([]time.Time, len(tt.bounds))
+			for i, b := range tt.bounds {
+				bounds[i] = h(b)
+			}
+			var at time.Time
+			if tt.at >= 0 {
+				at = h(tt.at)
+			}
+			var lookups []int
+			got, snap := pickArchive(bounds, at, func(i int) time.Time {
+				lookups = append(lookups, i)
+				return h(tt.snapshots[i])
+			})
+			if got != tt.want {
+				t.Fatalf("picked %d, want %d", got, tt.want)
+			}
+			if got >= 0 && !snap.Equal(h(tt.snapshots[got])) {
+				t.Errorf("snapshot %v, want %v", snap, h(tt.snapshots[got]))
+			}
+			if !reflect.DeepEqual(lookups, tt.lookups) {
+				t.Errorf("looked up %v, want %v", lookups, tt.lookups)
+			}
+		})
+	}
+}
@@ -0,0 +1,229 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+/********************** KEY RESTORE **********************/
+// restore-keys copies selected keys from an archive into a running instance
+// with RESTORE, without touching the rest of its data. Values travel as DUMP
+// payloads, so every type (and module data) keeps its exact encoding.
+
+// conflict policies for keys that already exist in the target
+const (
+	conflictReplace = "replace"
+	conflictSkip    = "skip"
+	conflictRename  = "rename"
+)
+
+type keyRestoreStats struct {
+	Restored, Replaced, Renamed, Skipped, Expired, Failed int64
+}
+
+func cmdRestoreKeys(args []string) int {
+	switch onConflict {
+	case conflictReplace, conflictSkip, conflictRename:
+	default:
+		fmt.Fprintf(os.Stderr, "%srestore-keys: --on-conflict must be replace, skip or rename%s\n", red, reset)
+		return 2
+	}
+	if onConflict == conflictRename && renamePrefix == "" {
+		fmt.Fprintf(os.Stderr, "%srestore-keys: --rename-prefix must not be empty%s\n", red, reset)
+		return 2
+	}
+	if targetPort == "" || keyPattern == "" {
+		fmt.Fprintf(os.Stderr, "%srestore-keys: --port and --match are required (use --match '*' for all keys)%s\n", red, reset)
+		return 2
+	}
+
+	var path string
+	switch len(args) {
+	case 0:
+		daily := dailyArchives(targetPort)
+		if len(daily) == 0 {
+			fmt.Fprintf(os.Stderr, "%srestore-keys: no daily archives for port %s%s\n", red, targetPort, reset)
+			return 2
+		}
+		path = daily[len(daily)-1]
+	case 1:
+		p, err := locateArchive(args[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%srestore-keys: %v%s\n", red, err, reset)
+			return 2
+		}
+		path = p
+	default:
+		fmt.Fprintf(os.Stderr, "%srestore-keys: expected one archive%s\n", red, reset)
+		return 2
+	}
+	if problem, fatal := checkSignaturePolicy(path); problem != "" {
+		fmt.Fprintf(os.Stderr, "%s%s%s\n", yellow, problem, reset)
+		if fatal {
+			return 2
+		}
+	}
+
+	// RESTORE rejects payloads of a newer RDB version, key by key
+	warnings, err := checkRDBCompat(path, targetPort)
+	if err != nil {
+		if !forceVersion {
+			fmt.Fprintf(os.Stderr, "%sRefusing to restore: %v (--force-version to override)%s\n", red, err, reset)
+			return 2
+		}
+		fmt.Fprintf(os.Stderr, "%s%v — trying anyway (--force-version)%s\n", yellow, err, reset)
+	}
+	for _, w := range warnings {
+		fmt.Fprintf(os.Stderr, "%s%s%s\n", yellow, w, reset)
+	}
+
+	conn, err := dialRedis(targetPort)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%sRedis %s: %v%s\n", red, targetPort, err, reset)
+		return 2
+	}
+	defer conn.Close()
+
+	a, err := openArchivedRDB(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s%s: %v%s\n", red, path, err, reset)
+		return 2
+	}
+	defer a.Close()
+
+	mode := ""
+	if dryRun {
+		mode = " (dry run, nothing is written)"
+	}
+	fmt.Printf("Restoring keys matching %q from %s into Redis %s, on conflict: %s%s\n",
+		keyPattern, path, targetPort, onConflict, mode)
+
+	var stats keyRestoreStats
+	currentDB := -1
+	_, err = parseRDB(a, captureAll, func(e *rdbEntry) error {
+		if filterDB >= 0 && e.DB != filterDB {
+			return nil
+		}
+		if !globMatch([]byte(keyPattern), e.Key) {
+			return nil
+		}
+		ttl := int64(0)
+		if e.ExpireMs > 0 {
+			if ttl = e.ExpireMs - time.Now().UnixMilli(); ttl <= 0 {
+				stats.Expired++
+				return nil
+			}
+		}
+		if e.DB != currentDB {
+			if _, err := conn.do("SELECT", e.DB); err != nil {
+				return fmt.Errorf("SELECT %d: %w", e.DB, err)
+			}
+			currentDB = e.DB
+		}
+		action, renamed, err := restoreKey(conn, e, ttl)
+		if err != nil {
+			if _, ok := err.(redisError); !ok {
+				return err // connection lost
+			}
+			stats.Failed++
+			fmt.Printf("%sFAIL     db%d %s: %v%s\n", red, e.DB, displayKey(e.Key), err, reset)
+			return nil
+		}
+		switch action {
+		case "restored":
+			stats.Restored++
+		case "replaced":
+			stats.Replaced++
+		case "skipped":
+			stats.Skipped++
+		case "renamed":
+			stats.Renamed++
+			fmt.Printf("%-8s db%d %s -> %s\n", action, e.DB, displayKey(e.Key), displayKey(renamed))
+			return nil
+		}
+		fmt.Printf("%-8s db%d %s\n", action, e.DB, displayKey(e.Key))
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s%v%s\n", red, err, reset)
+		return 2
+	}
+
+	fmt.Printf("restored %d, replaced %d, renamed %d, skipped %d, expired %d, failed %d\n",
+		stats.Restored, stats.Replaced, stats.Renamed, stats.Skipped, stats.Expired, stats.Failed)
+	if stats.Failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// restoreKey applies the conflict policy to one key and reports what was
+// (or, in a dry run, would be) done: restored, replaced, skipped or renamed,
+// the latter with the new key name.
+func restoreKey(conn *redisConn, e *rdbEntry, ttl int64) (string, []byte, error) {
+	payload := dumpPayload(e)
+	exists := func(key []byte) (bool, error) {
+		n, err := conn.do("EXISTS", key)
+		return n == int64(1), err
+	}
+	busy := func(err error) bool {
+		re, ok := err.(redisError)
+		return ok && strings.HasPrefix(string(re), "BUSYKEY")
+	}
+
+	switch onConflict {
+	case conflictReplace:
+		found, err := exists(e.Key)
+		if err != nil {
+			return "", nil, err
+		}
+		if !dryRun {
+			if _, err := conn.do("RESTORE", e.Key, ttl, payload, "REPLACE"); err != nil {
+				return "", nil, err
+			}
+		}
+		if found {
+			return "replaced", nil, nil
+		}
+		return "restored", nil, nil
+	}
+
+	// skip and rename never overwrite: RESTORE without REPLACE fails with
+	// BUSYKEY atomically, even if the key appears in the meantime
+	if dryRun {
+		found, err := exists(e.Key)
+		if err != nil || !found {
+			return "restored", nil, err
+		}
+	} else {
+		_, err := conn.do("RESTORE", e.Key, ttl, payload)
+		if err == nil {
+			return "restored", nil, nil
+		}
+		if !busy(err) {
+			return "", nil, err
+		}
+	}
+	if onConflict == conflictSkip {
+		return "skipped", nil, nil
+	}
+
+	renamed := append([]byte(renamePrefix), e.Key...)
+	if dryRun {
+		found, err := exists(renamed)
+		if err != nil || found {
+			return "skipped", nil, err
+		}
+	} else if _, err := conn.do("RESTORE", renamed, ttl, payload); err != nil {
+		if busy(err) {
+			return "skipped", nil, nil // the renamed key is taken as well
+		}
+		return "", nil, err
+	}
+	return "renamed", renamed, nil
+}
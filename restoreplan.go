@@ -0,0 +1,381 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+/******************** RESTORE PLAN ********************/
+// planRestore runs every lookup and check of a restore without changing
+// anything. restoreBackup executes the plan; --dry-run only prints it.
+
+// datasetStats describes a dataset before or after the restore.
+type datasetStats struct {
+	Bytes int64            `json:"bytes"`
+	Keys  int64            `json:"keys"`
+	DBs   map[string]int64 `json:"dbs,omitempty"`
+	From  string           `json:"from"` // where the numbers come from
+}
+
+type restorePlan struct {
+	SourcePort   string        `json:"source_port"`
+	TargetPort   string        `json:"target_port"`
+	Archive      string        `json:"archive"`
+	Tier         string        `json:"tier"`
+	SnapshotTime string        `json:"snapshot_time,omitempty"`
+	RDBFile      string        `json:"rdb_file"`
+	RenameTo     string        `json:"rename_to,omitempty"`
+	UID          int           `json:"uid"`
+	GID          int           `json:"gid"`
+	OwnerFrom    string        `json:"owner_from,omitempty"`
+	Mode         string        `json:"mode"`
+	RDBVersion   int           `json:"rdb_version,omitempty"`
+	TargetRedis  string        `json:"target_redis_version,omitempty"`
+	MaxRDB       int           `json:"target_max_rdb_version,omitempty"`
+	Running      bool          `json:"running"`
+	StopWith     string        `json:"stop_with,omitempty"`
+	StartWith    string        `json:"start_with,omitempty"`
+	Current      *datasetStats `json:"current,omitempty"`
+	Restored     *datasetStats `json:"restored,omitempty"`
+	Warnings     []string      `json:"warnings,omitempty"`
+
+	archivePath string
+	mode        os.FileMode
+	expected    *keyspaceSummary
+	launcher    *redisLauncher
+	rawRDB      bool // archivePath is a plain RDB (a pre-restore snapshot)
+	rollbackOf  int  // journal entry undone by this plan
+}
+
+func (p *restorePlan) warn(msg string) {
+	log.Printf("%s⚠  %s%s", yellow, msg, reset)
+	p.Warnings = append(p.Warnings, msg)
+}
+
+// planRestore resolves what restoring archivePath into target would do.
+// On a refusal the partial plan is returned together with the error.
+func planRestore(archivePath, target string) (*restorePlan, error) {
+	p := &restorePlan{TargetPort: target, Archive: archivePath, UID: -1, GID: -1, mode: 0644}
+	if m := archiveNameRe.FindStringSubmatch(archivePath); m != nil {
+		p.SourcePort = m[1]
+	}
+	p.Tier = filepath.Base(filepath.Dir(archivePath))
+
+	if strings.HasSuffix(archivePath, unchangedSuffix) {
+		m, err := readUnchangedMarker(archivePath)
+		if err != nil {
+			suggestSudo(err)
+			return nil, restoreFailf(exitRestoreUsage, "cannot read %s: %v", archivePath, err)
+		}
+		archivePath = filepath.Join(filepath.Dir(archivePath), m.SameAs)
+		p.Archive = archivePath
+		log.Printf("%sSnapshot was unchanged, using %s%s", cyan, m.SameAs, reset)
+	}
+	p.archivePath = archivePath
+
+	if !archiveExists(archivePath) {
+		return nil, restoreFailf(exitRestoreUsage, "archive %s not found", archivePath)
+	}
+	if err := checkVolumes(archivePath); err != nil {
+		return p, restoreFailf(exitRestoreRefused, "archive %s is incomplete: %v", archivePath, err)
+	}
+	if err := checkArchiveEntries(archivePath); err != nil {
+		return p, restoreFailf(exitRestoreRefused, "refusing to restore: %v", err)
+	}
+	if problem, fatal := checkSignaturePolicy(archivePath); fatal {
+		return p, restoreFailf(exitRestoreRefused, "refusing to restore: %s", problem)
+	} else if problem != "" {
+		p.warn(problem)
+	}
+
+	meta, _ := readBackupMeta(archivePath)
+	if meta.SnapshotTime > 0 {
+		p.SnapshotTime = time.Unix(meta.SnapshotTime, 0).Format(time.RFC3339)
+	}
+	if s, err := archiveKeyspace(archivePath); err == nil {
+		p.expected = s
+		p.RDBVersion = s.RDBVersion
+		p.Restored = &datasetStats{Keys: s.Keys, DBs: make(map[string]int64), From: "archive"}
+		for db, n := range s.DBs {
+			p.Restored.DBs[db] = n.Keys
+		}
+		if size, err := archivedPayloadSize(archivePath); err == nil {
+			p.Restored.Bytes = size
+		}
+	} else {
+		p.warn("no key counts to verify against: " + err.Error())
+	}
+
+	if v, err := targetRedisVersion(target); err == nil {
+		p.TargetRedis, p.MaxRDB = v, maxRDBVersion(v)
+	}
+	warnings, err := checkRDBCompat(archivePath, target)
+	if err != nil {
+		if !forceVersion {
+			return p, restoreFailf(exitRestoreRefused, "refusing to restore: %v (--force-version to override)", err)
+		}
+		p.warn(err.Error() + " — restoring anyway (--force-version)")
+	}
+	for _, w := range warnings {
+		p.warn(w)
+	}
+
+	return p, p.planTarget()
+}
+
+// planTarget fills in what happens on the target's side: the files, their
+// owner, and how a running instance is stopped and started.
+func (p *restorePlan) planTarget() error {
+	target := p.TargetPort
+	restoreDir := getRedisDir(target)
+	fileName := getRedisRDB(target)
+	if restoreDir == "" || fileName == "" {
+		return restoreFailf(exitRestoreUsage, "cannot determine Redis directory for port %s", target)
+	}
+	p.RDBFile = filepath.Join(restoreDir, fileName)
+
+	if info, err := os.Stat(p.RDBFile); err == nil {
+		p.mode = info.Mode()
+		p.RenameTo = snapshotName(p.RDBFile, time.Now())
+		p.Current = &datasetStats{Bytes: info.Size(), From: "rdb file"}
+	}
+	p.Mode = p.mode.String()
+	p.planOwner(restoreDir)
+
+	// a running target is stopped first, otherwise it would overwrite the
+	// restored file with its in-memory dataset on the next save
+	if redisRunning(target) {
+		p.Running = true
+		if p.RenameTo == "" {
+			p.RenameTo = snapshotName(p.RDBFile, time.Now()) // SAVE creates the file
+		}
+		l, err := prepareLauncher(target)
+		if err != nil {
+			return restoreFailf(exitRestoreRefused, "cannot restart Redis %s after the restore: %v", target, err)
+		}
+		p.launcher = l
+		p.StopWith = describeStop()
+		if startCmd != "" {
+			p.StartWith = startCmd
+		} else {
+			p.StartWith = strings.Join(l.argv, " ")
+			if l.aof {
+				p.StartWith += " --appendonly no (AOF rewritten afterwards)"
+			}
+		}
+		if c, err := dialRedis(target); err == nil {
+			if loaded, err := loadedKeyspace(c); err == nil {
+				if p.Current == nil {
+					p.Current = &datasetStats{}
+				}
+				p.Current.From = "running instance"
+				p.Current.Keys, p.Current.DBs = 0, make(map[string]int64)
+				for db, n := range loaded {
+					p.Current.DBs[db] = n.Keys
+					p.Current.Keys += n.Keys
+				}
+			}
+			c.Close()
+		}
+	} else if p.Current != nil {
+		if f, err := os.Open(p.RDBFile); err == nil {
+			if s, err := summarizeRDB(f); err == nil {
+				p.Current.Keys, p.Current.DBs = s.Keys, make(map[string]int64)
+				for db, n := range s.DBs {
+					p.Current.DBs[db] = n.Keys
+				}
+			}
+			f.Close()
+		}
+	}
+	return nil
+}
+
+// planOwner decides who owns the restored file: the user the redis-server
+// process runs as, else the owner of the current RDB, else that of the
+// directory. Owner and mode in the archive are never used. It warns when
+// Redis could not read the file or save (rename) in the directory.
+func (p *restorePlan) planOwner(restoreDir string) {
+	redisUID, redisGID := -1, -1
+	if proc, err := redisProcess(p.TargetPort); err == nil {
+		if uid, gid, err := processOwner(proc); err == nil {
+			redisUID, redisGID = int(uid), int(gid)
+			p.UID, p.GID, p.OwnerFrom = redisUID, redisGID, "redis-server process"
+		}
+	}
+	if p.OwnerFrom == "" {
+		for _, f := range []string{p.RDBFile, restoreDir} {
+			if uid, gid, ok := fileOwner(f); ok {
+				p.UID, p.GID, p.OwnerFrom = uid, gid, f
+				break
+			}
+		}
+	}
+	if p.UID < 0 {
+		return
+	}
+	if redisUID < 0 {
+		redisUID, redisGID = p.UID, p.GID
+	}
+
+	fileUID, fileGID := p.UID, p.GID
+	if euid := os.Geteuid(); euid != 0 && euid != p.UID {
+		p.warn(fmt.Sprintf("not running as root: the restored file stays owned by uid %d instead of %d", euid, p.UID))
+		fileUID, fileGID = euid, os.Getegid()
+	}
+	groups := userGroups(redisUID, redisGID)
+	if !permits(fileUID, fileGID, p.mode, redisUID, groups, 04) {
+		p.warn(fmt.Sprintf("Redis (uid %d) could not read the restored file (owner %d:%d, mode %s)", redisUID, fileUID, fileGID, p.mode))
+	}
+	if info, err := os.Stat(restoreDir); err == nil {
+		if uid, gid, ok := fileOwner(restoreDir); ok && !permits(uid, gid, info.Mode(), redisUID, groups, 03) {
+			p.warn(fmt.Sprintf("Redis (uid %d) cannot write to %s, so its next save would fail to rename the new RDB into place", redisUID, restoreDir))
+		}
+	}
+}
+
+func fileOwner(path string) (uid, gid int, ok bool) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, 0, false
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(stat.Uid), int(stat.Gid), true
+}
+
+// userGroups returns gid and the supplementary groups of uid.
+func userGroups(uid, gid int) map[int]bool {
+	groups := map[int]bool{gid: true}
+	if u, err := user.LookupId(strconv.Itoa(uid)); err == nil {
+		ids, _ := u.GroupIds()
+		for _, id := range ids {
+			if n, err := strconv.Atoi(id); err == nil {
+				groups[n] = true
+			}
+		}
+	}
+	return groups
+}
+
+// permits tells whether uid (in groups) has the want bits (4 = r, 2 = w,
+// 1 = x) on a file of owner:group with mode.
+func permits(owner, group int, mode os.FileMode, uid int, groups map[int]bool, want os.FileMode) bool {
+	perm := mode.Perm()
+	switch {
+	case uid == 0:
+		return true
+	case uid == owner:
+		perm >>= 6
+	case groups[group]:
+		perm >>= 3
+	}
+	return perm&want == want
+}
+
+// printPlan shows a plan for people.
+func printPlan(p *restorePlan) {
+	if p.rollbackOf > 0 {
+		fmt.Printf("%s📋 Rollback plan (undoes #%d)%s\n", cyan, p.rollbackOf, reset)
+	} else {
+		fmt.Printf("%s📋 Restore plan%s\n", cyan, reset)
+	}
+	archive := filepath.Join(p.Tier, filepath.Base(p.Archive))
+	if p.SnapshotTime != "" {
+		archive += " (snapshot " + p.SnapshotTime + ")"
+	}
+	fmt.Printf("  Archive       %s\n", archive)
+	if p.RDBVersion > 0 {
+		switch {
+		case p.TargetRedis == "":
+			fmt.Printf("  RDB version   v%d, target Redis version unknown\n", p.RDBVersion)
+		case p.RDBVersion <= p.MaxRDB:
+			fmt.Printf("  RDB version   v%d → Redis %s reads up to v%d %s✔%s\n", p.RDBVersion, p.TargetRedis, p.MaxRDB, green, reset)
+		default:
+			fmt.Printf("  RDB version   v%d → Redis %s reads up to v%d %s✘%s\n", p.RDBVersion, p.TargetRedis, p.MaxRDB, red, reset)
+		}
+	}
+	if p.RDBFile == "" {
+		return
+	}
+	if p.Running {
+		fmt.Printf("  Redis %-7s running: stop with %s\n", p.TargetPort, p.StopWith)
+		fmt.Printf("                start with %s\n", p.StartWith)
+	} else {
+		fmt.Printf("  Redis %-7s not running, loads the file when started\n", p.TargetPort)
+	}
+	if p.RenameTo != "" {
+		saved := ""
+		if p.Running {
+			saved = " (after SAVE)"
+		}
+		fmt.Printf("  Current RDB   %s%s → %s\n", p.RDBFile, saved, filepath.Base(p.RenameTo))
+	} else {
+		fmt.Printf("  Current RDB   none\n")
+	}
+	verb := "Extract to"
+	if p.rawRDB {
+		verb = "Copy to"
+	}
+	owner := fmt.Sprintf("owner %d:%d", p.UID, p.GID)
+	if p.OwnerFrom != "" {
+		owner += " from " + p.OwnerFrom
+	}
+	fmt.Printf("  %-13s %s (%s, mode %s)\n", verb, p.RDBFile, owner, p.Mode)
+
+	if p.Current == nil && p.Restored == nil {
+		return
+	}
+	cur, res := p.Current, p.Restored
+	if cur == nil {
+		cur = &datasetStats{From: "none"}
+	}
+	if res == nil {
+		res = &datasetStats{From: "unknown"}
+	}
+	fmt.Printf("  Dataset       current (%s) → restored\n", cur.From)
+	dbs := make(map[string]bool)
+	for db := range cur.DBs {
+		dbs[db] = true
+	}
+	for db := range res.DBs {
+		dbs[db] = true
+	}
+	var names []string
+	for db := range dbs {
+		names = append(names, db)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, _ := strconv.Atoi(names[i])
+		b, _ := strconv.Atoi(names[j])
+		return a < b
+	})
+	for _, db := range names {
+		fmt.Printf("    db%-10s %10d → %-10d %s\n", db, cur.DBs[db], res.DBs[db], signedDelta(res.DBs[db]-cur.DBs[db]))
+	}
+	fmt.Printf("    %-12s %10d → %-10d %s\n", "keys", cur.Keys, res.Keys, signedDelta(res.Keys-cur.Keys))
+	fmt.Printf("    %-12s %10.1f → %-10.1f %+.1f MB\n", "size", humanMB(cur.Bytes), humanMB(res.Bytes), humanMB(res.Bytes-cur.Bytes))
+}
+
+func signedDelta(n int64) string {
+	switch {
+	case n > 0:
+		return fmt.Sprintf("%s+%d%s", green, n, reset)
+	case n < 0:
+		return fmt.Sprintf("%s%d%s", red, n, reset)
+	}
+	return "±0"
+}
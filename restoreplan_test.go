@@ -0,0 +1,92 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPermits(t *testing.T) {
+	member := map[int]bool{100: true}
+	tests := []struct {
+		name         string
+		owner, group int
+		mode         os.FileMode
+		uid          int
+		want         os.FileMode
+		ok           bool
+	}{
+		{"root reads anything", 1, 1, 0000, 0, 04, true},
+		{"owner read", 5, 1, 0400, 5, 04, true},
+		{"owner without write", 5, 1, 0444, 5, 02, false},
+		{"group read", 1, 100, 0640, 5, 04, true},
+		{"group bits ignored for owner", 5, 100, 0070, 5, 04, false},
+		{"other read", 1, 1, 0644, 5, 04, true},
+		{"other blocked", 1, 1, 0640, 5, 04, false},
+		{"dir write needs w and x", 1, 1, 0757, 5, 03, true},
+		{"dir without x", 1, 1, 0776, 5, 03, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := permits(tt.owner, tt.group, tt.mode, tt.uid, member, tt.want); got != tt.ok {
+				t.Fatalf("permits = %v, want %v", got, tt.ok)
+			}
+		})
+	}
+}
+
+func TestPlanOwner(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to hand files to another user")
+	}
+	const redisUID, redisGID = 12345, 12345
+	tests := []struct {
+		name     string
+		rdb      bool // current RDB exists, owned by redisUID
+		dirOwner int
+		dirMode  os.FileMode
+		wantUID  int
+		wantFrom string // "rdb" or "dir"
+		warn     string // "" = no warning
+	}{
+		{"owner of the current RDB", true, redisUID, 0755, redisUID, "rdb", ""},
+		{"owner of the directory", false, redisUID, 0755, redisUID, "dir", ""},
+		{"directory Redis cannot write", true, 0, 0755, redisUID, "rdb", "cannot write"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "redis")
+			if err := os.Mkdir(dir, tt.dirMode); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chown(dir, tt.dirOwner, tt.dirOwner); err != nil {
+				t.Fatal(err)
+			}
+			rdb := filepath.Join(dir, "dump.rdb")
+			if tt.rdb {
+				if err := os.WriteFile(rdb, emptyRDB(), 0600); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Chown(rdb, redisUID, redisGID); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// nothing listens on port 1, so the owner comes from the files
+			p := &restorePlan{TargetPort: "1", RDBFile: rdb, UID: -1, GID: -1, mode: 0600}
+			p.planOwner(dir)
+			from := map[string]string{"rdb": rdb, "dir": dir}[tt.wantFrom]
+			if p.UID != tt.wantUID || p.OwnerFrom != from {
+				t.Errorf("owner %d from %q, want %d from %q", p.UID, p.OwnerFrom, tt.wantUID, from)
+			}
+			warnings := strings.Join(p.Warnings, "\n")
+			if tt.warn == "" && warnings != "" || !strings.Contains(warnings, tt.warn) {
+				t.Errorf("warnings %q, want %q", warnings, tt.warn)
+			}
+		})
+	}
+}
@@ -0,0 +1,367 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+/********************** SANDBOX REDIS **********************/
+// A throw-away redis-server on a random loopback port with its own temp
+// directory. It loads an archived dump so the backup is proven restorable
+// by Redis itself, not just by our parser.
+
+type sandboxRedis struct {
+	Port string
+	Dir  string
+	cmd  *exec.Cmd
+	done chan error
+}
+
+// freeLoopbackPort asks the kernel for an unused port.
+func freeLoopbackPort() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+	_, port, err := net.SplitHostPort(l.Addr().String())
+	return port, err
+}
+
+// startSandbox runs redis-server on dir/dump.rdb. Persistence is off, so
+// nothing is written back; extra options override the defaults.
+func startSandbox(dir string, extra ...string) (*sandboxRedis, error) {
+	port, err := freeLoopbackPort()
+	if err != nil {
+		return nil, err
+	}
+	args := []string{
+		"--port", port, "--bind", "127.0.0.1", "--protected-mode", "yes",
+		"--dir", dir, "--dbfilename", "dump.rdb",
+		"--save", "", "--appendonly", "no", "--daemonize", "no",
+		"--logfile", filepath.Join(dir, "redis.log"),
+	}
+	cmd := exec.Command(redisServerBin, append(args, extra...)...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true} // keep ^C for us
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("starting %s: %w", redisServerBin, err)
+	}
+	s := &sandboxRedis{Port: port, Dir: dir, cmd: cmd, done: make(chan error, 1)}
+	go func() { s.done <- cmd.Wait() }()
+	return s, nil
+}
+
+// logTail returns the last lines of the sandbox log, for error messages.
+func (s *sandboxRedis) logTail() string {
+	data, _ := os.ReadFile(filepath.Join(s.Dir, "redis.log"))
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) > 3 {
+		lines = lines[len(lines)-3:]
+	}
+	return strings.Join(lines, " | ")
+}
+
+// waitLoaded waits until the sandbox answers and has finished loading.
+func (s *sandboxRedis) waitLoaded(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		select {
+		case <-s.done:
+			return fmt.Errorf("redis-server exited: %s", s.logTail())
+		default:
+		}
+		// short slices, so a server that died is noticed
+		if err := waitForLoading(s.Port, time.Second); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("not ready after %s: %s", timeout, s.logTail())
+}
+
+// stop shuts the sandbox down without saving and kills it if it hangs.
+func (s *sandboxRedis) stop() {
+	if c, err := dialRedis(s.Port); err == nil {
+		_, _ = c.do("SHUTDOWN", "NOSAVE")
+		c.Close()
+	}
+	select {
+	case <-s.done:
+	case <-time.After(10 * time.Second):
+		_ = s.cmd.Process.Kill()
+		<-s.done
+	}
+}
+
+/*************** INSTANCE STATE ***************/
+
+// redisInfo returns the fields of one INFO section.
+func redisInfo(c *redisConn, section string) (map[string]string, error) {
+	reply, err := c.do("INFO", section)
+	if err != nil {
+		return nil, err
+	}
+	raw, ok := reply.([]byte)
+	if !ok {
+		return nil, errors.New("unexpected INFO reply")
+	}
+	out := make(map[string]string)
+	for _, line := range strings.Split(string(raw), "\n") {
+		if k, v, ok := strings.Cut(strings.TrimSpace(line), ":"); ok {
+			out[k] = v
+		}
+	}
+	return out, nil
+}
+
+// waitForLoading polls INFO persistence until the dataset is loaded.
+// A server still loading answers most commands with -LOADING.
+func waitForLoading(port string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	var lastErr error
+	for {
+		c, err := dialRedis(port)
+		if err == nil {
+			var info map[string]string
+			info, err = redisInfo(c, "persistence")
+			c.Close()
+			if err == nil && info["loading"] == "0" {
+				return nil
+			}
+			if err == nil {
+				err = fmt.Errorf("still loading (%s%% done)", info["loading_loaded_perc"])
+			}
+		}
+		lastErr = err
+		if time.Now().After(deadline) {
+			return lastErr
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+// loadedKeyspace reads INFO keyspace: "db0:keys=10,expires=2,avg_ttl=0".
+func loadedKeyspace(c *redisConn) (map[string]dbSummary, error) {
+	info, err := redisInfo(c, "keyspace")
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]dbSummary)
+	for k, v := range info {
+		if !strings.HasPrefix(k, "db") {
+			continue
+		}
+		var db dbSummary
+		for _, kv := range strings.Split(v, ",") {
+			name, num, _ := strings.Cut(kv, "=")
+			n, _ := strconv.ParseInt(num, 10, 64)
+			switch name {
+			case "keys":
+				db.Keys = n
+			case "expires":
+				db.Expires = n
+			}
+		}
+		out[strings.TrimPrefix(k, "db")] = db
+	}
+	return out, nil
+}
+
+/*************** TEST RESTORE ***************/
+
+// restoreTestResult is kept in the archive's .meta.
+type restoreTestResult struct {
+	Time         int64  `json:"time"`
+	OK           bool   `json:"ok"`
+	RedisVersion string `json:"redis_version,omitempty"`
+	Keys         int64  `json:"keys"`
+	LoadMillis   int64  `json:"load_ms"`
+	Error        string `json:"error,omitempty"`
+}
+
+// testRestore loads an archive into a sandbox and compares what Redis
+// reports with the keyspace recorded in the manifest.
+func testRestore(path string) restoreTestResult {
+	res := restoreTestResult{Time: time.Now().Unix()}
+	fail := func(err error) restoreTestResult {
+		res.Error = err.Error()
+		return res
+	}
+
+	meta, _ := readBackupMeta(path)
+	expected := meta.Keyspace
+	if expected == nil {
+		s, err := summarizeArchive(path)
+		if err != nil {
+			return fail(err)
+		}
+		expected = s
+	}
+
+	if _, err := checkRDBCompat(path, ""); err != nil {
+		return fail(err)
+	}
+
+	dir, err := os.MkdirTemp("", "redis-backup-test-")
+	if err != nil {
+		return fail(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := extractRDB(path, filepath.Join(dir, "dump.rdb")); err != nil {
+		return fail(err)
+	}
+
+	start := time.Now()
+	sb, err := startSandbox(dir)
+	if err != nil {
+		return fail(err)
+	}
+	defer sb.stop()
+	if err := sb.waitLoaded(time.Duration(loadTimeoutSec) * time.Second); err != nil {
+		return fail(err)
+	}
+	res.LoadMillis = time.Since(start).Milliseconds()
+
+	c, err := dialRedis(sb.Port)
+	if err != nil {
+		return fail(err)
+	}
+	defer c.Close()
+	if server, err := redisInfo(c, "server"); err == nil {
+		res.RedisVersion = server["redis_version"]
+	}
+	loaded, err := loadedKeyspace(c)
+	if err != nil {
+		return fail(err)
+	}
+
+	total, err := compareKeyspace(expected, loaded)
+	res.Keys = total
+	if err != nil {
+		return fail(err)
+	}
+	res.OK = true
+	return res
+}
+
+// compareKeyspace checks the key counts Redis loaded against the manifest
+// and returns the number of keys loaded.
+func compareKeyspace(expected *keyspaceSummary, loaded map[string]dbSummary) (int64, error) {
+	// keys whose TTL ran out since the snapshot are dropped on load,
+	// so a db may hold fewer keys, but never fewer than its persistent ones
+	var total int64
+	var problems []string
+	for name, want := range expected.DBs {
+		got := loaded[name]
+		total += got.Keys
+		if got.Keys > want.Keys || got.Keys < want.Keys-want.Expires {
+			problems = append(problems, fmt.Sprintf("db%s: %d keys loaded, manifest has %d", name, got.Keys, want.Keys))
+		}
+	}
+	for name, got := range loaded {
+		if _, ok := expected.DBs[name]; !ok {
+			total += got.Keys
+			problems = append(problems, fmt.Sprintf("db%s: %d keys loaded, not in manifest", name, got.Keys))
+		}
+	}
+	if len(problems) > 0 {
+		return total, errors.New(strings.Join(problems, "; "))
+	}
+	return total, nil
+}
+
+// recordRestoreTest stores the result next to the archive.
+func recordRestoreTest(path string, res restoreTestResult) error {
+	meta, err := readBackupMeta(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	meta.RestoreTest = &res
+	return saveBackupMeta(path, meta)
+}
+
+// latestRestoreTest finds the newest recorded test of an instance in any tier.
+func latestRestoreTest(instDir string) (string, *restoreTestResult) {
+	var name string
+	var latest *restoreTestResult
+	for _, tier := range backupTiers {
+		matches, _ := filepath.Glob(filepath.Join(instDir, tier, "*.tar.gz.meta"))
+		for _, m := range matches {
+			meta, err := readBackupMeta(strings.TrimSuffix(m, ".meta"))
+			if err != nil || meta.RestoreTest == nil {
+				continue
+			}
+			if latest == nil || meta.RestoreTest.Time > latest.Time {
+				latest, name = meta.RestoreTest, filepath.Base(strings.TrimSuffix(m, ".meta"))
+			}
+		}
+	}
+	return name, latest
+}
+
+func cmdTestRestore(args []string) int {
+	var archives []string
+	for _, a := range args {
+		p, err := locateArchive(a)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%stest-restore: %v%s\n", red, err, reset)
+			return 2
+		}
+		archives = append(archives, p)
+	}
+	if len(archives) == 0 {
+		// newest daily archive of the given or of every backed up instance
+		ports := []string{targetPort}
+		if targetPort == "" {
+			ports = nil
+			dirs, _ := filepath.Glob(filepath.Join(sourceBackupRoot(), "redis_*"))
+			for _, d := range dirs {
+				ports = append(ports, strings.TrimPrefix(filepath.Base(d), "redis_"))
+			}
+		}
+		for _, port := range ports {
+			if daily := dailyArchives(port); len(daily) > 0 {
+				archives = append(archives, daily[len(daily)-1])
+			}
+		}
+	}
+	if len(archives) == 0 {
+		fmt.Printf("%sNo archives found.%s\n", yellow, reset)
+		return 1
+	}
+	if _, err := exec.LookPath(redisServerBin); err != nil {
+		fmt.Fprintf(os.Stderr, "%stest-restore needs redis-server (--redis-server): %v%s\n", red, err, reset)
+		return 2
+	}
+
+	failed := 0
+	for _, a := range archives {
+		res := testRestore(a)
+		if err := recordRestoreTest(a, res); err != nil {
+			suggestSudo(err)
+			fmt.Printf("%sCannot record result for %s: %v%s\n", yellow, a, err, reset)
+		}
+		if !res.OK {
+			failed++
+			fmt.Printf("%sFAIL %s: %s%s\n", red, a, res.Error, reset)
+			continue
+		}
+		fmt.Printf("%sOK   %s%s (%d keys loaded by Redis %s in %.1fs)\n",
+			green, a, reset, res.Keys, res.RedisVersion, float64(res.LoadMillis)/1000)
+	}
+	fmt.Printf("%d archive(s) test-restored, %d failed\n", len(archives), failed)
+	if failed > 0 {
+		return 2
+	}
+	return 0
+}
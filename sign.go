@@ -0,0 +1,347 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/******************** SIGNATURES ********************/
+// Every archive gets a manifest (name, host, checksums of the stored files
+// and of the RDB) signed with the host's Ed25519 key. The X.tar.gz.sig
+// sidecar travels with the archive to FTP, so a copy pulled back later can
+// be proven to come from this host and to be unmodified.
+
+const signatureSuffix = ".sig"
+
+// signature policies for restore and check mode
+const (
+	sigPolicyOff     = "off"
+	sigPolicyWarn    = "warn"
+	sigPolicyRequire = "require"
+)
+
+var errNoSignature = errors.New("no signature")
+
+type archiveManifest struct {
+	Archive      string         `json:"archive"`
+	Host         string         `json:"host"`
+	Port         string         `json:"port"`
+	CreatedAt    int64          `json:"created_at"`
+	RDBSHA256    string         `json:"rdb_sha256,omitempty"`
+	OriginalSize int64          `json:"original_size,omitempty"`
+	Files        []manifestFile `json:"files"`
+}
+
+type manifestFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+type signatureFile struct {
+	Manifest  json.RawMessage `json:"manifest"`
+	KeyID     string          `json:"key_id"`
+	Signature string          `json:"signature"`
+}
+
+func keyID(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
+
+/*************** KEYS ***************/
+
+// generateSigningKey writes a new PKCS#8 private key and its PKIX public half (<path>.pub).
+func generateSigningKey(path string) error {
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("%s already exists", path)
+	}
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	privDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return err
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDER}), 0600); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path+".pub", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}), 0644); err != nil {
+		return err
+	}
+	log.Printf("%s🔑 Signing key %s (id %s), public key %s.pub%s", green, path, keyID(pub), path, reset)
+	return nil
+}
+
+func loadSigningKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: not a PEM file", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an Ed25519 key", path)
+	}
+	return priv, nil
+}
+
+func loadVerifyKey(path string) (ed25519.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: not a PEM file", path)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	pub, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an Ed25519 key", path)
+	}
+	return pub, nil
+}
+
+// verifyKeyPath is --verify-key, or the public half stored next to --sign-key.
+func verifyKeyPath() string {
+	if verifyKeyFile != "" {
+		return verifyKeyFile
+	}
+	return signKeyFile + ".pub"
+}
+
+/*************** SIGN ***************/
+
+func buildManifest(archivePath, host, port string) (archiveManifest, error) {
+	m := archiveManifest{
+		Archive:   filepath.Base(archivePath),
+		Host:      host,
+		Port:      port,
+		CreatedAt: time.Now().Unix(),
+	}
+	if meta, err := readBackupMeta(archivePath); err == nil {
+		m.RDBSHA256 = meta.RDBSHA256
+		m.OriginalSize = meta.OriginalSize
+	}
+	for _, f := range archiveFiles(archivePath) {
+		if filepath.Base(f) == m.Archive+volumeIndexSuffix {
+			continue // the volumes themselves are listed
+		}
+		info, err := os.Stat(f)
+		if err != nil {
+			return m, err
+		}
+		sum, err := fileSHA256(f)
+		if err != nil {
+			return m, err
+		}
+		m.Files = append(m.Files, manifestFile{Name: filepath.Base(f), Size: info.Size(), SHA256: sum})
+	}
+	return m, nil
+}
+
+// signArchive writes <archive>.sig if a signing key is configured.
+func signArchive(archivePath, host, port string) error {
+	if _, err := os.Stat(signKeyFile); err != nil {
+		return nil // signing not set up on this host
+	}
+	priv, err := loadSigningKey(signKeyFile)
+	if err != nil {
+		return err
+	}
+	m, err := buildManifest(archivePath, host, port)
+	if err != nil {
+		return err
+	}
+	raw, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	sig := signatureFile{
+		Manifest:  raw,
+		KeyID:     keyID(priv.Public().(ed25519.PublicKey)),
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(priv, raw)),
+	}
+	// not indented: the manifest must stay byte-for-byte what was signed
+	data, err := json.Marshal(sig)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(archivePath+signatureSuffix, append(data, '\n'), 0644)
+}
+
+/*************** VERIFY ***************/
+
+// verifyArchiveSignature checks the signature and that the stored files match the manifest.
+func verifyArchiveSignature(archivePath string, pub ed25519.PublicKey) (archiveManifest, error) {
+	data, err := os.ReadFile(archivePath + signatureSuffix)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return archiveManifest{}, errNoSignature
+		}
+		return archiveManifest{}, err
+	}
+	var sig signatureFile
+	if err := json.Unmarshal(data, &sig); err != nil {
+		return archiveManifest{}, fmt.Errorf("malformed signature file: %v", err)
+	}
+	raw, err := base64.StdEncoding.DecodeString(sig.Signature)
+	if err != nil {
+		return archiveManifest{}, fmt.Errorf("malformed signature: %v", err)
+	}
+	var signed bytes.Buffer
+	if err := json.Compact(&signed, sig.Manifest); err != nil {
+		return archiveManifest{}, fmt.Errorf("malformed manifest: %v", err)
+	}
+	if !ed25519.Verify(pub, signed.Bytes(), raw) {
+		return archiveManifest{}, fmt.Errorf("signature does not verify with key %s (signed by %s)", keyID(pub), sig.KeyID)
+	}
+
+	var m archiveManifest
+	if err := json.Unmarshal(sig.Manifest, &m); err != nil {
+		return archiveManifest{}, err
+	}
+	if m.Archive != filepath.Base(archivePath) {
+		return m, fmt.Errorf("signature belongs to %s", m.Archive)
+	}
+	if err := checkManifestFiles(filepath.Dir(archivePath), m); err != nil {
+		return m, err
+	}
+	return m, checkSignedSidecars(archivePath, m)
+}
+
+// checkManifestFiles compares the files in dir with the checksums of a manifest.
+func checkManifestFiles(dir string, m archiveManifest) error {
+	for _, f := range m.Files {
+		sum, err := fileSHA256(filepath.Join(dir, f.Name))
+		if err != nil {
+			return err
+		}
+		if sum != f.SHA256 {
+			return fmt.Errorf("%s was modified after signing", f.Name)
+		}
+	}
+	return nil
+}
+
+// checkSignedSidecars holds the unsigned sidecars to the manifest: the
+// volume index must list exactly the signed volumes and .meta must carry the
+// signed RDB checksum, otherwise a rewritten index or .meta slips through.
+func checkSignedSidecars(archivePath string, m archiveManifest) error {
+	if isSplitArchive(archivePath) {
+		idx, err := readVolumeIndex(archivePath + volumeIndexSuffix)
+		if err != nil {
+			return err
+		}
+		signed := make(map[string]manifestFile, len(m.Files))
+		for _, f := range m.Files {
+			signed[f.Name] = f
+		}
+		if len(idx.Parts) != len(m.Files) {
+			return fmt.Errorf("%s%s does not list the signed volumes", m.Archive, volumeIndexSuffix)
+		}
+		for _, p := range idx.Parts {
+			if f, ok := signed[p.Name]; !ok || f.Size != p.Size || f.SHA256 != p.SHA256 {
+				return fmt.Errorf("%s%s does not list the signed volumes", m.Archive, volumeIndexSuffix)
+			}
+		}
+	}
+	if meta, err := readBackupMeta(archivePath); err == nil && m.RDBSHA256 != "" && meta.RDBSHA256 != m.RDBSHA256 {
+		return fmt.Errorf("%s.meta does not carry the signed RDB checksum", m.Archive)
+	}
+	return nil
+}
+
+// readSignedManifest returns the manifest of <archive>.sig without checking
+// the signature itself (that is up to --sig-policy).
+func readSignedManifest(archivePath string) (archiveManifest, error) {
+	data, err := os.ReadFile(archivePath + signatureSuffix)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return archiveManifest{}, errNoSignature
+		}
+		return archiveManifest{}, err
+	}
+	var sig signatureFile
+	var m archiveManifest
+	if err := json.Unmarshal(data, &sig); err != nil {
+		return m, fmt.Errorf("malformed signature file: %v", err)
+	}
+	if err := json.Unmarshal(sig.Manifest, &m); err != nil {
+		return m, fmt.Errorf("malformed manifest: %v", err)
+	}
+	return m, nil
+}
+
+// expectedRDBSHA256 is the checksum the RDB inside an archive must have: the
+// signed one when the archive carries a signature, else the one in .meta.
+func expectedRDBSHA256(archivePath string) (sum, source string) {
+	if m, err := readSignedManifest(archivePath); err == nil && m.RDBSHA256 != "" {
+		return m.RDBSHA256, "the signed manifest"
+	}
+	if meta, err := readBackupMeta(archivePath); err == nil && meta.RDBSHA256 != "" {
+		return meta.RDBSHA256, ".meta"
+	}
+	return "", ""
+}
+
+// checkSignaturePolicy applies --sig-policy to an archive.
+// It returns a problem description (empty if fine) and whether it is fatal.
+func checkSignaturePolicy(archivePath string) (string, bool) {
+	if sigPolicy == sigPolicyOff {
+		return "", false
+	}
+	fatal := sigPolicy == sigPolicyRequire
+
+	pub, err := loadVerifyKey(verifyKeyPath())
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) && !fatal {
+			return "", false // signing was never set up here; "warn" stays quiet
+		}
+		return fmt.Sprintf("cannot load verify key: %v", err), fatal
+	}
+	m, err := verifyArchiveSignature(archivePath, pub)
+	switch {
+	case errors.Is(err, errNoSignature):
+		return fmt.Sprintf("%s is not signed", filepath.Base(archivePath)), fatal
+	case err != nil:
+		return fmt.Sprintf("%s: %v", filepath.Base(archivePath), err), fatal
+	}
+	log.Printf("%s🔏 Signature OK: %s from host %s%s", green, m.Archive, m.Host, reset)
+	return "", false
+}
@@ -0,0 +1,131 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"encoding/json"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useTestSigningKey points --sign-key at a new key for the current test.
+func useTestSigningKey(t *testing.T) {
+	t.Helper()
+	saved := signKeyFile
+	t.Cleanup(func() { signKeyFile = saved })
+	signKeyFile = filepath.Join(t.TempDir(), "sign.key")
+	if err := generateSigningKey(signKeyFile); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// signedTestArchive writes a signed split archive with a .meta next to it.
+func signedTestArchive(t *testing.T) string {
+	t.Helper()
+	useTestSigningKey(t)
+	dir := t.TempDir()
+
+	rdb := filepath.Join(dir, "dump.rdb")
+	data := make([]byte, 4000)
+	rand.New(rand.NewSource(1)).Read(data)
+	if err := os.WriteFile(rdb, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	sum, err := fileSHA256(rdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archive := filepath.Join(dir, "2025-01-01_03-00-00_redis_6379.tar.gz")
+	if err := createTarGzVolumes(archive, []string{rdb}, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeBackupMeta(archive, rdb, sum); err != nil {
+		t.Fatal(err)
+	}
+	if err := signArchive(archive, "host", "6379"); err != nil {
+		t.Fatal(err)
+	}
+	return archive
+}
+
+func TestVerifyArchiveSignatureTamper(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(t *testing.T, archive string)
+		want   string
+	}{
+		{"untouched", func(*testing.T, string) {}, ""},
+		{"volume modified", func(t *testing.T, archive string) {
+			vol := volumeName(archive, 2)
+			b, _ := os.ReadFile(vol)
+			b[0] ^= 0xFF
+			if err := os.WriteFile(vol, b, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}, "modified after signing"},
+		{"index lists an extra volume", func(t *testing.T, archive string) {
+			idx, err := readVolumeIndex(archive + volumeIndexSuffix)
+			if err != nil {
+				t.Fatal(err)
+			}
+			vol := volumeName(archive, len(idx.Parts)+1)
+			if err := os.WriteFile(vol, []byte("forged"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			sum, _ := fileSHA256(vol)
+			idx.Parts = append(idx.Parts, volumePart{Name: filepath.Base(vol), Size: 6, SHA256: sum})
+			idx.TotalSize += 6
+			data, _ := json.Marshal(idx)
+			if err := os.WriteFile(archive+volumeIndexSuffix, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}, "does not list the signed volumes"},
+		{"index drops a volume", func(t *testing.T, archive string) {
+			idx, err := readVolumeIndex(archive + volumeIndexSuffix)
+			if err != nil {
+				t.Fatal(err)
+			}
+			idx.Parts = idx.Parts[:len(idx.Parts)-1]
+			data, _ := json.Marshal(idx)
+			if err := os.WriteFile(archive+volumeIndexSuffix, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}, "does not list the signed volumes"},
+		{"meta checksum rewritten", func(t *testing.T, archive string) {
+			meta, err := readBackupMeta(archive)
+			if err != nil {
+				t.Fatal(err)
+			}
+			meta.RDBSHA256 = strings.Repeat("0", 64)
+			data, _ := json.Marshal(meta)
+			if err := os.WriteFile(archive+".meta", data, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}, "signed RDB checksum"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			archive := signedTestArchive(t)
+			pub, err := loadVerifyKey(verifyKeyPath())
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.tamper(t, archive)
+			_, err = verifyArchiveSignature(archive, pub)
+			if tt.want == "" {
+				if err != nil {
+					t.Fatalf("verify: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("verify: %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
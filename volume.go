@@ -0,0 +1,487 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jlaffaye/ftp"
+)
+
+/*********************** VOLUMES ************************/
+// With --volume-size the archive stream is cut into X.tar.gz.001, .002, …
+// and described by the small X.tar.gz.parts index. The index is written
+// last: an archive without it is incomplete and ignored by every reader.
+// Everywhere else the archive is still called X.tar.gz (its logical name).
+
+const volumeIndexSuffix = ".parts"
+
+type volumeIndex struct {
+	Archive    string       `json:"archive"`
+	VolumeSize int64        `json:"volume_size"`
+	TotalSize  int64        `json:"total_size"`
+	Parts      []volumePart `json:"parts"`
+}
+
+type volumePart struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+func volumeName(archive string, n int) string {
+	return fmt.Sprintf("%s.%03d", archive, n)
+}
+
+// isVolumeName reports whether name looks like X.tar.gz.NNN.
+func isVolumeName(name string) bool {
+	i := strings.LastIndex(name, ".tar.gz.")
+	if i < 0 {
+		return false
+	}
+	num := name[i+len(".tar.gz."):]
+	if len(num) < 3 {
+		return false
+	}
+	for _, r := range num {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// archiveLogicalName maps a directory entry to the archive it stands for.
+func archiveLogicalName(name string) (string, bool) {
+	switch {
+	case strings.HasSuffix(name, ".tar.gz"):
+		return name, true
+	case strings.HasSuffix(name, ".tar.gz"+volumeIndexSuffix):
+		return strings.TrimSuffix(name, volumeIndexSuffix), true
+	}
+	return "", false
+}
+
+// isArchiveData reports whether name holds archive bytes (whole archive or volume).
+func isArchiveData(name string) bool {
+	return strings.HasSuffix(name, ".tar.gz") || isVolumeName(name)
+}
+
+/*************** WRITING ***************/
+
+// volumeWriter spreads the archive stream over fixed-size part files.
+// Parts are written under temporary names and published by commit().
+type volumeWriter struct {
+	archive string
+	limit   int64
+
+	cur     *os.File
+	curHash hash.Hash
+	curSize int64
+	index   volumeIndex
+}
+
+func newVolumeWriter(archive string, limit int64) *volumeWriter {
+	return &volumeWriter{
+		archive: archive,
+		limit:   limit,
+		index:   volumeIndex{Archive: filepath.Base(archive), VolumeSize: limit},
+	}
+}
+
+func (w *volumeWriter) Write(p []byte) (int, error) {
+	var n int
+	for len(p) > 0 {
+		if w.cur == nil {
+			if err := w.openPart(); err != nil {
+				return n, err
+			}
+		}
+		chunk := p
+		if room := w.limit - w.curSize; int64(len(chunk)) > room {
+			chunk = chunk[:room]
+		}
+		m, err := w.cur.Write(chunk)
+		w.curHash.Write(chunk[:m])
+		w.curSize += int64(m)
+		n += m
+		if err != nil {
+			return n, err
+		}
+		p = p[m:]
+		if w.curSize >= w.limit {
+			if err := w.closePart(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (w *volumeWriter) openPart() error {
+	name := volumeName(w.archive, len(w.index.Parts)+1)
+	f, err := os.Create(name + partialSuffix)
+	if err != nil {
+		return err
+	}
+	w.cur, w.curHash, w.curSize = f, sha256.New(), 0
+	return nil
+}
+
+func (w *volumeWriter) closePart() error {
+	if w.cur == nil {
+		return nil
+	}
+	f := w.cur
+	w.cur = nil
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	w.index.Parts = append(w.index.Parts, volumePart{
+		Name:   filepath.Base(strings.TrimSuffix(f.Name(), partialSuffix)),
+		Size:   w.curSize,
+		SHA256: hex.EncodeToString(w.curHash.Sum(nil)),
+	})
+	w.index.TotalSize += w.curSize
+	return nil
+}
+
+// commit renames the parts into place and writes the index that makes the archive visible.
+func (w *volumeWriter) commit() error {
+	if err := w.closePart(); err != nil {
+		return err
+	}
+	dir := filepath.Dir(w.archive)
+	for _, p := range w.index.Parts {
+		final := filepath.Join(dir, p.Name)
+		if err := os.Rename(final+partialSuffix, final); err != nil {
+			return err
+		}
+	}
+	data, err := json.MarshalIndent(w.index, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(w.archive+volumeIndexSuffix, append(data, '\n'), 0644)
+}
+
+// abort removes whatever was written; used when the archive could not be completed.
+func (w *volumeWriter) abort() {
+	if w.cur != nil {
+		w.cur.Close()
+		_ = os.Remove(w.cur.Name())
+		w.cur = nil
+	}
+	dir := filepath.Dir(w.archive)
+	for _, p := range w.index.Parts {
+		_ = os.Remove(filepath.Join(dir, p.Name) + partialSuffix)
+		_ = os.Remove(filepath.Join(dir, p.Name))
+	}
+}
+
+func createTarGzVolumes(dst string, files []string, limit int64) error {
+	w := newVolumeWriter(dst, limit)
+	if err := writeTarGz(w, files); err != nil {
+		w.abort()
+		return err
+	}
+	if err := w.commit(); err != nil {
+		w.abort()
+		return err
+	}
+	return nil
+}
+
+/*************** READING ***************/
+
+func readVolumeIndex(indexPath string) (volumeIndex, error) {
+	data, err := os.ReadFile(indexPath)
+	if err != nil {
+		return volumeIndex{}, err
+	}
+	var idx volumeIndex
+	if err := json.Unmarshal(data, &idx); err != nil {
+		return volumeIndex{}, err
+	}
+	if err := checkVolumeIndex(idx, filepath.Base(strings.TrimSuffix(indexPath, volumeIndexSuffix))); err != nil {
+		return volumeIndex{}, err
+	}
+	return idx, nil
+}
+
+// checkVolumeIndex makes sure an index names only the archive's own volumes,
+// <archive>.001, .002, … in order. The names are joined to the archive
+// directory, so anything else could make readers or retention leave it.
+func checkVolumeIndex(idx volumeIndex, archive string) error {
+	if len(idx.Parts) == 0 {
+		return fmt.Errorf("%s%s: no volumes listed", archive, volumeIndexSuffix)
+	}
+	for i, p := range idx.Parts {
+		if want := volumeName(archive, i+1); p.Name != want {
+			return fmt.Errorf("%s%s: volume %q where %q was expected", archive, volumeIndexSuffix, p.Name, want)
+		}
+	}
+	return nil
+}
+
+// isSplitArchive reports whether the logical archive path is stored as volumes.
+func isSplitArchive(path string) bool {
+	if _, err := os.Stat(path); err == nil {
+		return false
+	}
+	_, err := os.Stat(path + volumeIndexSuffix)
+	return err == nil
+}
+
+func archiveExists(path string) bool {
+	if _, err := os.Stat(path); err == nil {
+		return true
+	}
+	_, err := os.Stat(path + volumeIndexSuffix)
+	return err == nil
+}
+
+// archiveFiles lists the files that make up an archive, index last.
+func archiveFiles(path string) []string {
+	if !isSplitArchive(path) {
+		return []string{path}
+	}
+	idx, err := readVolumeIndex(path + volumeIndexSuffix)
+	if err != nil {
+		return []string{path + volumeIndexSuffix}
+	}
+	var out []string
+	for _, p := range idx.Parts {
+		out = append(out, filepath.Join(filepath.Dir(path), p.Name))
+	}
+	return append(out, path+volumeIndexSuffix)
+}
+
+func archiveSize(path string) (int64, error) {
+	if !isSplitArchive(path) {
+		info, err := os.Stat(path)
+		if err != nil {
+			return 0, err
+		}
+		return info.Size(), nil
+	}
+	idx, err := readVolumeIndex(path + volumeIndexSuffix)
+	if err != nil {
+		return 0, err
+	}
+	return idx.TotalSize, nil
+}
+
+func archiveModTime(path string) (time.Time, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		if info, err = os.Stat(path + volumeIndexSuffix); err != nil {
+			return time.Time{}, err
+		}
+	}
+	return info.ModTime(), nil
+}
+
+// checkVolumes verifies that every part of a split archive is present with the expected size.
+func checkVolumes(path string) error {
+	if !isSplitArchive(path) {
+		return nil
+	}
+	idx, err := readVolumeIndex(path + volumeIndexSuffix)
+	if err != nil {
+		return err
+	}
+	for _, p := range idx.Parts {
+		info, err := os.Stat(filepath.Join(filepath.Dir(path), p.Name))
+		if err != nil {
+			return fmt.Errorf("volume %s missing", p.Name)
+		}
+		if info.Size() != p.Size {
+			return fmt.Errorf("volume %s is %d bytes, expected %d", p.Name, info.Size(), p.Size)
+		}
+	}
+	return nil
+}
+
+// openArchive returns the archive byte stream, joining and verifying volumes if needed.
+func openArchive(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err == nil || !errors.Is(err, os.ErrNotExist) {
+		return f, err
+	}
+	idx, ierr := readVolumeIndex(path + volumeIndexSuffix)
+	if ierr != nil {
+		return nil, err // report the archive itself as missing
+	}
+	return &volumeReader{dir: filepath.Dir(path), parts: idx.Parts}, nil
+}
+
+type volumeReader struct {
+	dir   string
+	parts []volumePart
+
+	cur  *os.File
+	hash hash.Hash
+	read int64
+}
+
+func (r *volumeReader) Read(p []byte) (int, error) {
+	for {
+		if r.cur == nil {
+			if len(r.parts) == 0 {
+				return 0, io.EOF
+			}
+			f, err := os.Open(filepath.Join(r.dir, r.parts[0].Name))
+			if err != nil {
+				return 0, err
+			}
+			r.cur, r.hash, r.read = f, sha256.New(), 0
+		}
+		n, err := r.cur.Read(p)
+		r.hash.Write(p[:n])
+		r.read += int64(n)
+		if err == io.EOF {
+			part := r.parts[0]
+			r.cur.Close()
+			r.cur = nil
+			r.parts = r.parts[1:]
+			if r.read != part.Size || hex.EncodeToString(r.hash.Sum(nil)) != part.SHA256 {
+				return n, fmt.Errorf("volume %s is corrupt (size or checksum mismatch)", part.Name)
+			}
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (r *volumeReader) Close() error {
+	if r.cur != nil {
+		return r.cur.Close()
+	}
+	return nil
+}
+
+/*************** REMOVAL ***************/
+
+// removeArchive deletes an archive with all its volumes and sidecars.
+func removeArchive(path string) {
+	for _, f := range archiveFiles(path) {
+		_ = os.Remove(f)
+	}
+	// volumes not listed in a damaged index
+	if matches, _ := filepath.Glob(path + ".[0-9][0-9][0-9]*"); len(matches) > 0 {
+		for _, m := range matches {
+			if isVolumeName(filepath.Base(m)) {
+				_ = os.Remove(m)
+			}
+		}
+	}
+	_ = os.Remove(path + ".meta")
+	_ = os.Remove(path + signatureSuffix)
+}
+
+// removeOrphanVolumes deletes parts of archives whose index was never written.
+func removeOrphanVolumes(dir string, remove func(path string)) {
+	files, _ := os.ReadDir(dir)
+	for _, f := range files {
+		if f.IsDir() || !isVolumeName(f.Name()) {
+			continue
+		}
+		logical := f.Name()[:strings.LastIndex(f.Name(), ".")]
+		if _, err := os.Stat(filepath.Join(dir, logical+volumeIndexSuffix)); err != nil {
+			remove(filepath.Join(dir, f.Name()))
+		}
+	}
+}
+
+/*************** FTP ***************/
+
+// ftpRemoveArchive deletes a logical archive (or marker) with all its remote volumes.
+func ftpRemoveArchive(c *ftp.ServerConn, dir, name string, entries []*ftp.Entry) {
+	for _, e := range entries {
+		if e.Type != ftp.EntryTypeFile {
+			continue
+		}
+		if e.Name == name || e.Name == name+volumeIndexSuffix || e.Name == name+signatureSuffix || e.Name == name+".meta" ||
+			(isVolumeName(e.Name) && strings.HasPrefix(e.Name, name+".")) {
+			_ = c.Delete(filepath.ToSlash(filepath.Join(dir, e.Name)))
+		}
+	}
+}
+
+// ftpArchiveSize sums the remote size of a logical archive.
+func ftpArchiveSize(name string, entries []*ftp.Entry) int64 {
+	var sum int64
+	for _, e := range entries {
+		if e.Type != ftp.EntryTypeFile {
+			continue
+		}
+		if e.Name == name || (isVolumeName(e.Name) && strings.HasPrefix(e.Name, name+".")) {
+			sum += int64(e.Size)
+		}
+	}
+	return sum
+}
+
+// ftpCheckVolumes downloads the index of a split archive and checks that all parts are there.
+func ftpCheckVolumes(c *ftp.ServerConn, dir, name string, entries []*ftp.Entry) error {
+	split := false
+	sizes := make(map[string]uint64)
+	for _, e := range entries {
+		if e.Type != ftp.EntryTypeFile {
+			continue
+		}
+		if e.Name == name+volumeIndexSuffix {
+			split = true
+		}
+		sizes[e.Name] = e.Size
+	}
+	if !split {
+		return nil
+	}
+
+	resp, err := c.Retr(filepath.ToSlash(filepath.Join(dir, name+volumeIndexSuffix)))
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(resp)
+	resp.Close()
+	if err != nil {
+		return err
+	}
+	var idx volumeIndex
+	if err := json.Unmarshal(data, &idx); err != nil {
+		return err
+	}
+	if err := checkVolumeIndex(idx, name); err != nil {
+		return err
+	}
+	for _, p := range idx.Parts {
+		size, ok := sizes[p.Name]
+		if !ok {
+			return fmt.Errorf("volume %s missing", p.Name)
+		}
+		if int64(size) != p.Size {
+			return fmt.Errorf("volume %s is %d bytes, expected %d", p.Name, size, p.Size)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTestVolumes stores data as a split archive with limit-sized volumes.
+func writeTestVolumes(t *testing.T, data []byte, limit int64) string {
+	t.Helper()
+	archive := filepath.Join(t.TempDir(), "2025-01-01_03-00-00_redis_6379.tar.gz")
+	w := newVolumeWriter(archive, limit)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.commit(); err != nil {
+		t.Fatal(err)
+	}
+	return archive
+}
+
+func TestVolumeRoundTrip(t *testing.T) {
+	data := make([]byte, 10*1000+123)
+	rand.New(rand.NewSource(1)).Read(data)
+	archive := writeTestVolumes(t, data, 1000)
+
+	if !isSplitArchive(archive) {
+		t.Fatal("archive is not split")
+	}
+	files := archiveFiles(archive)
+	if len(files) != 12 || files[len(files)-1] != archive+volumeIndexSuffix {
+		t.Fatalf("archiveFiles = %v, want 11 volumes and the index last", files)
+	}
+	if size, _ := archiveSize(archive); size != int64(len(data)) {
+		t.Errorf("archiveSize = %d, want %d", size, len(data))
+	}
+	if err := checkVolumes(archive); err != nil {
+		t.Fatalf("checkVolumes: %v", err)
+	}
+
+	r, err := openArchive(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("data read back differs from data written")
+	}
+
+	// a flipped byte in a middle volume is caught by its checksum
+	vol := volumeName(archive, 5)
+	b, _ := os.ReadFile(vol)
+	b[10] ^= 0xFF
+	if err := os.WriteFile(vol, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	r, _ = openArchive(archive)
+	_, err = io.ReadAll(r)
+	r.Close()
+	if err == nil || !strings.Contains(err.Error(), "corrupt") {
+		t.Fatalf("corrupt volume: got %v, want a corrupt volume error", err)
+	}
+}
+
+func TestReadVolumeIndexRejectsForeignNames(t *testing.T) {
+	const archive = "2025-01-01_03-00-00_redis_6379.tar.gz"
+	tests := []struct {
+		name  string
+		parts []string
+		ok    bool
+	}{
+		{"own volumes", []string{archive + ".001", archive + ".002"}, true},
+		{"parent directory", []string{"../../victim"}, false},
+		{"absolute path", []string{"/etc/passwd"}, false},
+		{"subdirectory", []string{"sub/" + archive + ".001"}, false},
+		{"dot-dot suffix", []string{archive + ".001/../../victim"}, false},
+		{"other archive", []string{"2024-12-31_03-00-00_redis_6379.tar.gz.001"}, false},
+		{"out of order", []string{archive + ".002", archive + ".001"}, false},
+		{"no volumes", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idx := volumeIndex{Archive: archive}
+			for _, n := range tt.parts {
+				idx.Parts = append(idx.Parts, volumePart{Name: n, Size: 1})
+			}
+			data, _ := json.Marshal(idx)
+			path := filepath.Join(t.TempDir(), archive+volumeIndexSuffix)
+			if err := os.WriteFile(path, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			_, err := readVolumeIndex(path)
+			if tt.ok != (err == nil) {
+				t.Fatalf("readVolumeIndex: %v, want ok=%v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestRemoveArchiveStaysInItsDirectory(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "daily")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	victim := filepath.Join(root, "victim")
+	if err := os.WriteFile(victim, []byte("keep me"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	archive := filepath.Join(dir, "2025-01-01_03-00-00_redis_6379.tar.gz")
+	data, _ := json.Marshal(volumeIndex{Parts: []volumePart{{Name: "../victim", Size: 7}}})
+	if err := os.WriteFile(archive+volumeIndexSuffix, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	removeArchive(archive)
+	if _, err := os.Stat(victim); err != nil {
+		t.Fatalf("file outside the backup directory was removed: %v", err)
+	}
+	if _, err := openArchive(archive); err == nil {
+		t.Fatal("openArchive accepted an index pointing outside its directory")
+	}
+}